@@ -1,31 +1,46 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 
 	qs "github.com/JonasBak/homelab-gitops/quadlet_syncer"
+	"github.com/JonasBak/homelab-gitops/utils"
 	"github.com/sirupsen/logrus"
 )
 
 var l = logrus.New()
 var log = l.WithFields(logrus.Fields{})
 
-var environ = append(os.Environ())
+var environ = os.Environ()
 
 func main() {
-	if len(os.Args) == 1 {
+	// Stops orphaned services even if it's more than the mass removal limit allows
+	allowMassRemoval := false
+	args := []string{}
+	for _, arg := range os.Args {
+		if arg == "--allow-mass-removal" {
+			allowMassRemoval = true
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	if len(args) == 1 {
 		log.Fatalf("Expected command")
 	}
 
-	cmd := os.Args[1]
+	cmd := args[1]
 
-	syncer := qs.QuadletSyncer{}
+	syncer := qs.QuadletSyncer{
+		CheckImages: os.Getenv("CHECK_IMAGES") == "true",
+	}
 
 	switch cmd {
 	case "sync":
-		gitopsRepo := os.Args[2]
-		gitopsDir := os.Args[3]
+		gitopsRepo := args[2]
+		gitopsDir := args[3]
 
 		ref, hostGitopsDir := fetch(gitopsRepo, gitopsDir)
 
@@ -37,7 +52,7 @@ func main() {
 		if errUp != nil {
 			log.WithField("error", errUp.Error()).WithField("services", errUp.servicesErrored).Error("failed to start services")
 		}
-		errDown := orphansDown(&syncer)
+		errDown := orphansDown(&syncer, allowMassRemoval)
 		if errDown != nil {
 			log.WithField("error", errDown.Error()).WithField("services", errDown.servicesErrored).Error("failed to clean up services")
 		}
@@ -48,7 +63,7 @@ func main() {
 		}
 		break
 	case "up":
-		hostGitopsDir, err := filepath.Abs(os.Args[2])
+		hostGitopsDir, err := filepath.Abs(args[2])
 		if err != nil {
 			log.Fatal(err.Error())
 		}
@@ -58,14 +73,31 @@ func main() {
 		servicesUp(&syncer)
 		break
 	case "clean":
-		hostGitopsDir, err := filepath.Abs(os.Args[2])
+		hostGitopsDir, err := filepath.Abs(args[2])
 		if err != nil {
 			log.Fatal(err.Error())
 		}
 
 		syncer.HostGitopsDir = hostGitopsDir
 
-		orphansDown(&syncer)
+		if err := orphansDown(&syncer, allowMassRemoval); err != nil {
+			log.WithField("error", err.Error()).WithField("services", err.servicesErrored).Fatal("failed to clean up services")
+		}
+		break
+	case "validate":
+		hostGitopsDir, err := filepath.Abs(args[2])
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		errs := utils.ValidateHost(hostGitopsDir)
+		for _, err := range errs {
+			fmt.Println(err.Error())
+		}
+		if len(errs) > 0 {
+			log.Fatalf("validation failed with %d errors", len(errs))
+		}
+		log.Info("validation ok")
 		break
 	case "down":
 		allDown(&syncer)
@@ -0,0 +1,131 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// With service name and build context hash
+var BUILD_IMAGE_NAME = "localhost/gitops-%s:%s"
+
+// Length of the build context hash used in the image tag
+var BUILD_IMAGE_TAG_LENGTH = 16
+
+// Files in the service dir that are read by the syncer, and not part of the build context for the image
+func excludedFromBuildContext(name string) bool {
+	for _, file := range []string{utils.SERVICE_MANIFEST_FILE, utils.SERVICE_MANIFEST_SOPS_FILE, utils.SERVICE_QUADLET_FILE, utils.SERVICE_KUBE_FILE} {
+		if name == filepath.Base(fmt.Sprintf(file, "")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of the image built from the Containerfile in the service dir, or an empty string if the service
+// doesn't have a Containerfile. The tag is derived from the build context, so changes to the manifests don't cause
+// the image to be rebuilt. Files in .gitopsignore are still sent to podman build, so they are part of the tag.
+func buildImageName(serviceDir string, service string) (string, error) {
+	if !utils.PathExists(fmt.Sprintf(utils.SERVICE_CONTAINERFILE, serviceDir)) {
+		return "", nil
+	}
+	hash, err := utils.HashDir(serviceDir, utils.HashOptions{Exclude: excludedFromBuildContext, NoIgnoreFile: true})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(BUILD_IMAGE_NAME, service, hash[:BUILD_IMAGE_TAG_LENGTH]), nil
+}
+
+// Uses the built image for the containers that don't have an image
+func defaultToBuildImage(manifest utils.Manifest) {
+	for _, container := range manifest.ContainerSections() {
+		if container != nil && len(container["Image"]) == 0 {
+			container["Image"] = []string{"${BUILD_IMAGE}"}
+		}
+	}
+}
+
+// Builds the image from the Containerfile in the service dir, unless an image with the same tag already exists
+func buildImage(serviceDir string, image string, log *log.Entry) error {
+	log = log.WithField("image", image)
+
+	output, err := utils.RunCommandLog(log, "", os.Environ(), "podman", "images", "--quiet", image)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(output) != "" {
+		log.Info("image is already built")
+		return nil
+	}
+
+	log.Info("building image")
+	_, err = utils.RunCommandLog(log, serviceDir, os.Environ(), "podman", "build",
+		"--tag", image,
+		"--file", fmt.Sprintf(utils.SERVICE_CONTAINERFILE, serviceDir),
+		serviceDir,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to build image '%s': %s", image, err.Error())
+	}
+	return nil
+}
+
+// Returns the built images that aren't referenced by any of the unit files
+func unusedBuiltImages(images []string, unitFiles []string) []string {
+	unused := []string{}
+	for _, image := range images {
+		referenced := false
+		for _, content := range unitFiles {
+			referenced = referenced || strings.Contains(content, image)
+		}
+		if !referenced {
+			unused = append(unused, image)
+		}
+	}
+	return unused
+}
+
+// Removes the tags of built images that aren't used by any of the gitops unit files, since every change to the build
+// context creates a new tag. Images that can't be removed, like images used by a container, are kept until the next
+// prune.
+func pruneBuiltImages(quadletDir string) error {
+	output, err := utils.RunCommand("", os.Environ(), false, "podman", "images",
+		"--filter", fmt.Sprintf("reference=%s", fmt.Sprintf(BUILD_IMAGE_NAME, "*", "*")),
+		"--format", "{{.Repository}}:{{.Tag}}")
+	if err != nil {
+		return err
+	}
+	images := []string{}
+	for _, image := range strings.Fields(output) {
+		if !strings.HasSuffix(image, ":<none>") {
+			images = append(images, image)
+		}
+	}
+
+	files, err := filepath.Glob(fmt.Sprintf("%s/gitops-*", quadletDir))
+	if err != nil {
+		return err
+	}
+	unitFiles := []string{}
+	for _, file := range files {
+		content, err := utils.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		unitFiles = append(unitFiles, content)
+	}
+
+	for _, image := range unusedBuiltImages(images, unitFiles) {
+		log := log.WithField("image", image)
+		if _, err := utils.RunCommand("", os.Environ(), false, "podman", "rmi", image); err != nil {
+			log.WithField("error", err.Error()).Warn("failed to remove built image that is no longer used")
+			continue
+		}
+		log.Info("removed built image that is no longer used")
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Relative to home, with image name
+var IMAGE_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s.image"
+
+// With image name, quadlet adds -image to the name of the service for images
+var IMAGE_SERVICE_UNIT_NAME = "gitops-%s-image.service"
+
+// With image name, the value containers use in Image= to depend on the image unit
+var IMAGE_UNIT_REFERENCE = "gitops-%s.image"
+
+// Comment added to image unit files, with image name. Image units can be shared by several services, so they aren't
+// owned by a service, and are removed by Prune when no unit file references them.
+var IMAGE_UNIT_OWNER_COMMENT = "# gitops-image=%s"
+
+var imageNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Returns the name of the image unit for an image that isn't declared in config.yml, like
+// docker-io-library-redis-7-1a2b3c4d for docker.io/library/redis:7
+func implicitImageName(image string) string {
+	name := strings.Trim(imageNameReplacer.ReplaceAllString(image, "-"), "-_")
+	if len(name) > 40 {
+		name = strings.TrimRight(name[:40], "-_")
+	}
+	if name == "" {
+		name = "image"
+	}
+	return fmt.Sprintf("%s-%s", name, utils.HashStrings(image)[:8])
+}
+
+// Returns true for images that shouldn't get an image unit, because they already reference a unit or only exist locally
+func skipImageUnit(image string, builtImage string) bool {
+	return image == "" || image == builtImage || strings.HasSuffix(image, ".image") || strings.HasSuffix(image, ".build")
+}
+
+// Returns the image units for the images, image -> image unit name, and image unit name -> [Image] section. Images
+// declared in config.yml are matched by their Image, the rest get an image unit with only Image set.
+func imageUnits(images []string, declared map[string]map[string][]string) (map[string]string, map[string]map[string][]string) {
+	declaredNames := make(map[string]string)
+	for name, fields := range declared {
+		if len(fields["Image"]) == 1 {
+			declaredNames[fields["Image"][0]] = name
+		}
+	}
+
+	names := make(map[string]string)
+	units := make(map[string]map[string][]string)
+	for _, image := range images {
+		if name, ok := declaredNames[image]; ok {
+			names[image] = name
+			units[name] = declared[name]
+			continue
+		}
+		name := implicitImageName(image)
+		names[image] = name
+		units[name] = map[string][]string{"Image": {image}}
+	}
+	return names, units
+}
+
+func generateImageFile(name string, fields map[string][]string) (string, error) {
+	imageFields, err := utils.BuildFields(fields, map[string]string{})
+	if err != nil {
+		return "", fmt.Errorf("section Image: %s", err.Error())
+	}
+
+	file := fmt.Sprintf(`%s
+
+[Image]
+%s`, fmt.Sprintf(IMAGE_UNIT_OWNER_COMMENT, name), imageFields)
+
+	return file, nil
+}
+
+// Makes the Image= lines of a container unit file reference the image units, so the container depends on them
+func useImageUnits(content string, names map[string]string) string {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) != "Image" {
+			continue
+		}
+		if name, ok := names[strings.TrimSpace(kv[1])]; ok {
+			lines[i] = fmt.Sprintf("Image=%s", fmt.Sprintf(IMAGE_UNIT_REFERENCE, name))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Stages the image unit files that don't exist or have changed
+func writeImageUnitFiles(units map[string]map[string][]string, tx *unitTransaction) error {
+	quadletDir := fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME"))
+
+	for name, fields := range units {
+		if err := utils.ValidateName("image", name); err != nil {
+			return err
+		}
+		path := fmt.Sprintf(IMAGE_UNIT_FILE_PATH, os.Getenv("HOME"), name)
+		if err := utils.CheckInside(quadletDir, path); err != nil {
+			return err
+		}
+		content, err := generateImageFile(name, fields)
+		if err != nil {
+			return fmt.Errorf("image '%s': %s", name, err.Error())
+		}
+
+		existing, err := utils.ReadFile(path)
+		if err == nil && existing == content {
+			continue
+		}
+		if err == nil && !strings.HasPrefix(existing, fmt.Sprintf(IMAGE_UNIT_OWNER_COMMENT, name)+"\n") {
+			return fmt.Errorf("unit file '%s' already exists, and wasn't generated for the image", path)
+		}
+		if err := tx.write(path, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the digest of the local image, and false if it doesn't exist, replaced in tests
+var localImageDigest = func(image string, log *log.Entry) (string, bool, error) {
+	if _, err := utils.RunCommandLog(log, "", os.Environ(), "podman", "image", "exists", image); err != nil {
+		return "", false, nil
+	}
+	digest, err := utils.RunCommandLog(log, "", os.Environ(), "podman", "image", "inspect", "--format", "{{.Digest}}", image)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to inspect image '%s': %s", image, err.Error())
+	}
+	return strings.TrimSpace(digest), true, nil
+}
+
+// Pulls new versions of the tag of an image unit that only sets Image. Image units with other fields are started
+// instead when the image doesn't exist, after reloading the unit files with daemonReload if needed. Replaced in tests.
+var pullImageUnit = func(name string, fields map[string][]string, exists bool, daemonReload func() error, log *log.Entry) error {
+	image := fields["Image"][0]
+	switch {
+	case len(fields) == 1:
+		if exists {
+			log.Info("updating image")
+		} else {
+			log.Info("pulling image")
+		}
+		_, err := utils.RunCommandLog(log, "", os.Environ(), "podman", "pull", image)
+		return err
+	case !exists:
+		log.Info("pulling image")
+		if err := daemonReload(); err != nil {
+			return err
+		}
+		_, err := utils.RunCommandLog(log, "", os.Environ(), "systemctl", "--user", "start", fmt.Sprintf(IMAGE_SERVICE_UNIT_NAME, name))
+		return err
+	default:
+		return nil
+	}
+}
+
+// The digests of the images in a sync, shared by the services that are prepared at the same time. Services that don't
+// pull an image hash it with its digest from before the sync, even if another service has pulled a new version of it,
+// and each image is pulled at most once, so the service hashes don't depend on the order the services are prepared in.
+type imageDigestCache struct {
+	mu sync.Mutex
+	// Image -> lock held while the image is inspected or pulled
+	locks map[string]*sync.Mutex
+	// Image -> digest before the sync, empty if the image didn't exist
+	before map[string]string
+	// Image -> digest after the image was pulled in the sync
+	pulled map[string]string
+}
+
+// Locks the image, and returns the function that unlocks it
+func (c *imageDigestCache) lock(image string) func() {
+	c.mu.Lock()
+	if c.locks == nil {
+		c.locks = make(map[string]*sync.Mutex)
+		c.before = make(map[string]string)
+		c.pulled = make(map[string]string)
+	}
+	lock, ok := c.locks[image]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[image] = lock
+	}
+	c.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Returns the digest of the image from before the sync, must be called with the image locked
+func (c *imageDigestCache) digestBefore(image string, log *log.Entry) (string, error) {
+	c.mu.Lock()
+	digest, ok := c.before[image]
+	c.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	digest, _, err := localImageDigest(image, log)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.before[image] = digest
+	c.mu.Unlock()
+	return digest, nil
+}
+
+// Returns the digests of the images of the image units that exist, image -> digest. With pulled, the digests after the
+// images were pulled in the sync are used, otherwise the digests from before the sync.
+func (c *imageDigestCache) digests(units map[string]map[string][]string, pulled bool, log *log.Entry) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, name := range sortedUnitNames(units) {
+		image := units[name]["Image"][0]
+		log := log.WithField("image", image)
+
+		unlock := c.lock(image)
+		c.mu.Lock()
+		digest, ok := c.pulled[image]
+		c.mu.Unlock()
+		var err error
+		if !pulled || !ok {
+			digest, err = c.digestBefore(image, log)
+		}
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+		if digest != "" {
+			digests[image] = digest
+		}
+	}
+	return digests, nil
+}
+
+// Makes sure the images of the image units exist, and pulls new versions of the tags of units that only set Image, see
+// pullImageUnit. Images that have already been pulled in the sync aren't pulled again.
+func (c *imageDigestCache) pull(units map[string]map[string][]string, daemonReload func() error, log *log.Entry) error {
+	for _, name := range sortedUnitNames(units) {
+		if err := c.pullImage(name, units[name], daemonReload, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *imageDigestCache) pullImage(name string, fields map[string][]string, daemonReload func() error, log *log.Entry) error {
+	image := fields["Image"][0]
+	unit := fmt.Sprintf(IMAGE_SERVICE_UNIT_NAME, name)
+	log = log.WithField("image", image).WithField("unit", unit)
+
+	unlock := c.lock(image)
+	defer unlock()
+
+	c.mu.Lock()
+	_, pulled := c.pulled[image]
+	c.mu.Unlock()
+	if pulled {
+		log.Info("image is already pulled")
+		return nil
+	}
+
+	before, err := c.digestBefore(image, log)
+	if err != nil {
+		return err
+	}
+	if err := pullImageUnit(name, fields, before != "", daemonReload, log); err != nil {
+		log.Warn("failed to pull image")
+		return fmt.Errorf("failed to pull image '%s' (%s): %s", image, unit, err.Error())
+	}
+
+	digest, _, err := localImageDigest(image, log)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pulled[image] = digest
+	c.mu.Unlock()
+	return nil
+}
+
+func sortedUnitNames(units map[string]map[string][]string) []string {
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the images with a different digest than the running containers use, image -> pulled digest
+func updatedImages(running map[string]string, digests map[string]string) map[string]string {
+	updated := make(map[string]string)
+	for image, digest := range running {
+		if pulled, ok := digests[image]; ok && pulled != digest {
+			updated[image] = pulled
+		}
+	}
+	return updated
+}
+
+// Logs the images where a newer version than the running containers of the service use has been pulled
+func notifyImageUpdates(service string, digests map[string]string, log *log.Entry) {
+	output, err := utils.RunCommandLog(log, "", os.Environ(), "podman", "ps", "--quiet", "--filter", fmt.Sprintf("label=gitops-service=%s", service))
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("failed to check running containers for image updates")
+		return
+	}
+	containers := strings.Fields(output)
+	if len(containers) == 0 {
+		return
+	}
+
+	output, err = utils.RunCommandLog(log, "", os.Environ(), "podman", append([]string{"inspect", "--format", "{{.ImageName}} {{.ImageDigest}}"}, containers...)...)
+	if err != nil {
+		log.WithField("error", err.Error()).Warn("failed to check running containers for image updates")
+		return
+	}
+	running := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			running[fields[0]] = fields[1]
+		}
+	}
+
+	for image, digest := range updatedImages(running, digests) {
+		log.WithField("image", image).WithField("digest", digest).Warn("new image available, restart the service to use it")
+	}
+}
+
+// Returns the value of the first Image= line in the unit file
+func unitFileImage(content string) string {
+	for _, line := range unitFileLines(content) {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 && strings.TrimSpace(kv[0]) == "Image" {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// Returns true if the image unit, that pulls the image, is referenced by the unit file. Hand written unit files are
+// installed as they are, so they use the image directly instead of through the image unit.
+func referencesImageUnit(content string, name string, image string) bool {
+	return strings.Contains(content, fmt.Sprintf(IMAGE_UNIT_REFERENCE, name)) ||
+		strings.Contains(content, fmt.Sprintf(IMAGE_SERVICE_UNIT_NAME, name)) ||
+		(image != "" && unitFileImage(content) == image)
+}
+
+// Removes the image units that aren't referenced by any of the other gitops unit files
+func pruneImageUnits(quadletDir string) error {
+	files, err := filepath.Glob(fmt.Sprintf("%s/gitops-*", quadletDir))
+	if err != nil {
+		return err
+	}
+
+	images := make(map[string]string)
+	imageValues := make(map[string]string)
+	others := []string{}
+	for _, file := range files {
+		content, err := utils.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), "gitops-"), ".image")
+		if filepath.Ext(file) == ".image" && strings.HasPrefix(content, fmt.Sprintf(IMAGE_UNIT_OWNER_COMMENT, name)+"\n") {
+			images[name] = file
+			imageValues[name] = unitFileImage(content)
+			continue
+		}
+		others = append(others, content)
+	}
+
+	removed := false
+	for name, file := range images {
+		referenced := false
+		for _, content := range others {
+			referenced = referenced || referencesImageUnit(content, name, imageValues[name])
+		}
+		if referenced {
+			continue
+		}
+		log.WithField("file", file).Info("removing image unit that is no longer used")
+		if err := removeUnitFile(file); err != nil {
+			return err
+		}
+		removed = true
+	}
+
+	if removed {
+		_, err = utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "daemon-reload")
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+)
+
+// Relative to home, with service name and init container name
+var INIT_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s-init-%s.container"
+
+// With service name and init container name
+var INIT_SERVICE_UNIT_NAME = "gitops-%s-init-%s.service"
+
+// Returns the name of the systemd service that the unit files of the definition starts the service with
+func definitionMainUnitName(service string, definition serviceDefinition) string {
+	if definition.kubeYaml == "" && definition.manifest.IsPod() {
+		return fmt.Sprintf(POD_SERVICE_UNIT_NAME, service)
+	}
+	return fmt.Sprintf(SERVICE_UNIT_NAME, service)
+}
+
+// Makes the main unit of the service require the init containers, so they run every time before it starts
+func addInitDependencies(manifest *utils.Manifest, service string) {
+	if len(manifest.Init) == 0 {
+		return
+	}
+	if manifest.Unit == nil {
+		manifest.Unit = make(map[string][]string)
+	}
+	for _, name := range utils.SortedKeys(manifest.Init) {
+		unit := fmt.Sprintf(INIT_SERVICE_UNIT_NAME, service, name)
+		manifest.Unit["Requires"] = append(manifest.Unit["Requires"], unit)
+		manifest.Unit["After"] = append(manifest.Unit["After"], unit)
+	}
+}
+
+// Generates the unit file for an init container. The init containers run one at a time in the order of their names,
+// before the main unit, and are stopped and restarted together with it.
+func generateInitFile(container utils.PodContainer, service string, name string, previous string, mainUnit string, hash string, templateKV map[string]string) (string, error) {
+	unitSection := make(map[string][]string)
+	for k, v := range container.Unit {
+		unitSection[k] = append([]string{}, v...)
+	}
+	unitSection["Before"] = append(unitSection["Before"], mainUnit)
+	unitSection["PartOf"] = append(unitSection["PartOf"], mainUnit)
+	if previous != "" {
+		unitSection["After"] = append(unitSection["After"], fmt.Sprintf(INIT_SERVICE_UNIT_NAME, service, previous))
+	}
+
+	serviceSection := make(map[string][]string)
+	for k, v := range container.Service {
+		serviceSection[k] = v
+	}
+	if len(serviceSection["Type"]) == 0 {
+		serviceSection["Type"] = []string{"oneshot"}
+	}
+
+	containerFields, unitFields, serviceFields, err := buildContainerSections(container.Container, unitSection, serviceSection, templateKV)
+	if err != nil {
+		return "", err
+	}
+
+	file := fmt.Sprintf(`
+[Container]
+%s
+Label=gitops-service=%s
+Label=gitops-hash=%s
+Label=gitops-kind=init
+Label=gitops-init=%s
+
+[Unit]
+%s
+
+[Service]
+%s
+`, containerFields, service, hash, name, unitFields, serviceFields)
+
+	return file, nil
+}
@@ -0,0 +1,243 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Relative to home, timers aren't quadlet units so they are written to the systemd user dir
+var SYSTEMD_USER_DIR = "%s/.config/systemd/user"
+
+// Relative to home, with service name
+var JOB_TIMER_FILE_PATH = "%s/.config/systemd/user/gitops-%s.timer"
+
+// With service name
+var JOB_TIMER_UNIT_NAME = "gitops-%s.timer"
+
+// Relative to home, with service name. The hash of the job when the timer was last started, the timer file is
+// updated before the timer is restarted, so it can't be used to see what version of the job is active.
+var JOB_STATE_FILE_PATH = "%s/.local/state/gitops/timers/%s.hash"
+
+// Comment in the timer file with the hash of the job, with hash
+var JOB_TIMER_HASH_COMMENT = "# gitops-hash=%s"
+
+func jobTimerFilePath(service string) (string, error) {
+	path := fmt.Sprintf(JOB_TIMER_FILE_PATH, os.Getenv("HOME"), service)
+	return path, utils.CheckInside(fmt.Sprintf(SYSTEMD_USER_DIR, os.Getenv("HOME")), path)
+}
+
+func isJob(service string) bool {
+	path, err := jobTimerFilePath(service)
+	return err == nil && utils.PathExists(path)
+}
+
+// Generates the unit file for the container of a job. The container runs to completion when started by the timer,
+// so it isn't started on boot.
+func generateJobContainerFile(manifest utils.Manifest, service string, hash string, templateKV map[string]string) (string, error) {
+	serviceSection := make(map[string][]string)
+	for k, v := range manifest.Service {
+		serviceSection[k] = v
+	}
+	if len(serviceSection["Type"]) == 0 {
+		serviceSection["Type"] = []string{"oneshot"}
+	}
+
+	containerFields, unitFields, serviceFields, err := buildContainerSections(manifest.Container, manifest.Unit, serviceSection, templateKV)
+	if err != nil {
+		return "", err
+	}
+
+	file := fmt.Sprintf(`
+[Container]
+%s
+Label=gitops-service=%s
+Label=gitops-hash=%s
+Label=gitops-kind=job
+
+[Unit]
+%s
+
+[Service]
+%s
+`, containerFields, service, hash, unitFields, serviceFields)
+
+	return file, nil
+}
+
+func generateJobTimerFile(service string, schedule string, hash string) (string, error) {
+	schedule, err := utils.EscapeUnitValue(schedule)
+	if err != nil {
+		return "", fmt.Errorf("invalid schedule: %s", err.Error())
+	}
+
+	file := fmt.Sprintf(`%s
+%s
+
+[Unit]
+Description=Timer for gitops job %s
+
+[Timer]
+OnCalendar=%s
+Persistent=true
+Unit=%s
+
+[Install]
+WantedBy=timers.target
+`, fmt.Sprintf(UNIT_FILE_OWNER_COMMENT, service), fmt.Sprintf(JOB_TIMER_HASH_COMMENT, hash), service, schedule, fmt.Sprintf(SERVICE_UNIT_NAME, service))
+
+	return file, nil
+}
+
+// Stages the timer file for the job if it doesn't exist or has changed, after checking that the schedule is valid
+func writeJobTimerFile(service string, schedule string, hash string, tx *unitTransaction, log *log.Entry) error {
+	content, err := generateJobTimerFile(service, schedule, hash)
+	if err != nil {
+		return err
+	}
+	path, err := jobTimerFilePath(service)
+	if err != nil {
+		return err
+	}
+	existing, err := utils.ReadFile(path)
+	if err == nil && existing == content {
+		return nil
+	}
+	if err == nil && !ownedBy(existing, service) {
+		return fmt.Errorf("timer file '%s' already exists, and wasn't generated for the service", path)
+	}
+
+	if _, err := utils.RunCommandLog(log, "", os.Environ(), "systemd-analyze", "calendar", schedule); err != nil {
+		return fmt.Errorf("invalid schedule '%s': %s", schedule, err.Error())
+	}
+	return tx.write(path, content)
+}
+
+// Returns the path of the timer file of the service, or an empty string if it doesn't have one
+func ownedJobTimerFile(service string) (string, error) {
+	path, err := jobTimerFilePath(service)
+	if err != nil {
+		return "", err
+	}
+	if !utils.PathExists(path) {
+		return "", nil
+	}
+	content, err := utils.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !ownedBy(content, service) {
+		return "", fmt.Errorf("timer file '%s' wasn't generated for the service", path)
+	}
+	return path, nil
+}
+
+// Stops and disables the timer of the service, and forgets the hash of the timer that was started
+func disableJobTimer(service string) error {
+	_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "disable", "--now", fmt.Sprintf(JOB_TIMER_UNIT_NAME, service))
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(fmt.Sprintf(JOB_STATE_FILE_PATH, os.Getenv("HOME"), service))
+	return nil
+}
+
+// Stops and removes the timer of the service, if it has one
+func removeJobTimer(service string) error {
+	path, err := ownedJobTimerFile(service)
+	if err != nil || path == "" {
+		return err
+	}
+	log.WithField("service", service).WithField("file", path).Info("removing timer")
+	if err := disableJobTimer(service); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Stages the removal of the timer of the service, if it has one
+func stageJobTimerRemoval(service string, tx *unitTransaction) error {
+	path, err := ownedJobTimerFile(service)
+	if err != nil || path == "" {
+		return err
+	}
+	log.WithField("service", service).WithField("file", path).Info("removing timer")
+	tx.remove(path, func() error {
+		return disableJobTimer(service)
+	})
+	return nil
+}
+
+// Returns the hash in the timer file
+func timerFileHash(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		var hash string
+		if _, err := fmt.Sscanf(strings.TrimSpace(line), JOB_TIMER_HASH_COMMENT, &hash); err == nil {
+			return hash
+		}
+	}
+	return ""
+}
+
+// Enables and (re)starts the timer of the job, and records the hash of the timer that was started
+func restartJobTimer(service string) error {
+	path, err := jobTimerFilePath(service)
+	if err != nil {
+		return err
+	}
+	content, err := utils.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	timer := fmt.Sprintf(JOB_TIMER_UNIT_NAME, service)
+	if _, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "enable", timer); err != nil {
+		return err
+	}
+	if _, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "restart", timer); err != nil {
+		return err
+	}
+
+	statePath := fmt.Sprintf(JOB_STATE_FILE_PATH, os.Getenv("HOME"), service)
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, []byte(timerFileHash(content)), 0600)
+}
+
+// Returns a map of job name -> hash, for the jobs with an active timer
+func runningJobs() (map[string]string, error) {
+	timers, err := filepath.Glob(fmt.Sprintf(JOB_TIMER_FILE_PATH, os.Getenv("HOME"), "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make(map[string]string)
+	for _, path := range timers {
+		service := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "gitops-"), ".timer")
+		content, err := utils.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !ownedBy(content, service) {
+			continue
+		}
+
+		state, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "show", "--property", "ActiveState", "--value", fmt.Sprintf(JOB_TIMER_UNIT_NAME, service))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(state) != "active" {
+			continue
+		}
+
+		// The timer is active, but if the state is missing it's not known which version of the job it is
+		hash, _ := utils.ReadFile(fmt.Sprintf(JOB_STATE_FILE_PATH, os.Getenv("HOME"), service))
+		jobs[service] = strings.TrimSpace(hash)
+	}
+	return jobs, nil
+}
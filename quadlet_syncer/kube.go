@@ -0,0 +1,154 @@
+package quadlet_syncer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Relative to home, with service name
+var KUBE_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s.kube"
+
+// Relative to home, with service name. The kube yaml with the gitops labels added, next to the kube unit file.
+var KUBE_YAML_FILE_PATH = "%s/.config/containers/systemd/gitops-%s.yml"
+
+// Returns the value of the key in the mapping node, creating an empty mapping for it if create is true
+func mappingValue(node *yaml.Node, key string, create bool) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	if !create {
+		return nil
+	}
+	value := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
+
+func setMappingValue(node *yaml.Node, key string, value string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+			return
+		}
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+}
+
+// Returns the pod spec and pod metadata of a kubernetes resource, for pods and resources with a pod template
+func podNodes(document *yaml.Node, create bool) (*yaml.Node, *yaml.Node) {
+	switch mappingValue(document, "kind", false).Value {
+	case "Pod":
+		return mappingValue(document, "spec", false), mappingValue(document, "metadata", create)
+	case "Deployment", "DaemonSet", "ReplicaSet", "Job":
+		template := mappingValue(mappingValue(document, "spec", false), "template", false)
+		return mappingValue(template, "spec", false), mappingValue(template, "metadata", create)
+	}
+	return nil, nil
+}
+
+// Adds the gitops labels to the pods in the kube yaml, and returns it with the images used by the pods
+func processKubeYaml(content string, service string, hash string) (string, []string, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader([]byte(content)))
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+
+	images := []string{}
+	pods := 0
+	for {
+		document := yaml.Node{}
+		err := decoder.Decode(&document)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+			continue
+		}
+		root := document.Content[0]
+		if mappingValue(root, "kind", false) == nil {
+			return "", nil, fmt.Errorf("kube yaml document without kind")
+		}
+
+		spec, metadata := podNodes(root, true)
+		if metadata != nil {
+			labels := mappingValue(metadata, "labels", true)
+			setMappingValue(labels, "gitops-service", service)
+			setMappingValue(labels, "gitops-hash", hash)
+			pods++
+		}
+		for _, key := range []string{"initContainers", "containers"} {
+			containers := mappingValue(spec, key, false)
+			if containers == nil {
+				continue
+			}
+			for _, container := range containers.Content {
+				if image := mappingValue(container, "image", false); image != nil {
+					images = append(images, image.Value)
+				}
+			}
+		}
+
+		if err := encoder.Encode(&document); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		return "", nil, err
+	}
+
+	if pods == 0 {
+		return "", nil, fmt.Errorf("kube yaml doesn't contain any pods")
+	}
+
+	return fmt.Sprintf("%s\n%s", fmt.Sprintf(UNIT_FILE_OWNER_COMMENT, service), out.String()), images, nil
+}
+
+func generateKubeFile(manifest utils.Manifest, service string, yamlPath string, templateKV map[string]string) (string, error) {
+	kubeFields, err := utils.BuildFields(manifest.Kube, templateKV)
+	if err != nil {
+		return "", fmt.Errorf("section Kube: %s", err.Error())
+	}
+	unitFields, err := utils.BuildFields(manifest.Unit, templateKV)
+	if err != nil {
+		return "", fmt.Errorf("section Unit: %s", err.Error())
+	}
+	serviceFields, err := utils.BuildFields(manifest.Service, templateKV)
+	if err != nil {
+		return "", fmt.Errorf("section Service: %s", err.Error())
+	}
+
+	file := fmt.Sprintf(`%s
+
+[Install]
+WantedBy=default.target
+
+[Kube]
+%sYaml=%s
+
+[Unit]
+%s
+
+[Service]
+%s
+`, fmt.Sprintf(UNIT_FILE_OWNER_COMMENT, service), kubeFields, filepath.Base(yamlPath), unitFields, serviceFields)
+
+	return file, nil
+}
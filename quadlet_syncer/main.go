@@ -6,11 +6,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/JonasBak/homelab-gitops/utils"
 	log "github.com/sirupsen/logrus"
 )
 
+// Relative to home
+var QUADLET_DIR = "%s/.config/containers/systemd"
+
 // Relative to home, with service name
 var CONTAINER_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s.container"
 
@@ -20,11 +27,30 @@ var SERVICE_UNIT_NAME = "gitops-%s.service"
 type QuadletSyncer struct {
 	HostGitopsDir string
 	Environ       []string
+	// Pull new versions of the tags for all the services, not only for the services that have changed
+	CheckImages bool
+
+	// The config for the host, for the settings that aren't per service like the declared images
+	hostConfig  *utils.Config
+	hostSecrets map[string]string
+	// The running services when the first service was created, used to only pull images for changed services
+	runningServices map[string]string
+	// Services are created concurrently, this protects the fields above
+	mu sync.Mutex
+
+	// The unit files staged by the services, applied by ReloadUnits
+	units unitTransaction
+	// Set when systemd might run older unit files than the ones on disk, like after a sync that failed before the
+	// daemon-reload, so ReloadUnits reloads even if no files changed
+	reloadNeeded bool
+
+	// The images pulled by the services, so services that share an image hash it the same way
+	images imageDigestCache
 }
 
 var _ utils.ServiceSyncer = &QuadletSyncer{}
 
-func (s *QuadletSyncer) GetConfig() utils.Config {
+func (s *QuadletSyncer) GetConfig() (utils.Config, error) {
 	return utils.ReadConfigFile(fmt.Sprintf(utils.CONFIG_FILE_PATH, s.HostGitopsDir))
 }
 
@@ -32,18 +58,144 @@ func (s *QuadletSyncer) GetRunningServices() (map[string]string, error) {
 	return parseRunningServices()
 }
 
-func (s *QuadletSyncer) CreateService(service string, serviceConfig utils.Service) (string, error) {
-	return createAndPrepareService(s.HostGitopsDir, service, serviceConfig)
+func (s *QuadletSyncer) CreateService(service string, serviceConfig utils.Service) (utils.Service, error) {
+	if err := s.readHostState(); err != nil {
+		return serviceConfig, err
+	}
+	return s.createAndPrepareService(service, serviceConfig)
+}
+
+// Reads the host config, the host secrets and the running services the first time a service is created
+func (s *QuadletSyncer) readHostState() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostConfig == nil {
+		config, err := s.GetConfig()
+		if err != nil {
+			return fmt.Errorf("failed to read config: %s", err.Error())
+		}
+		s.hostConfig = &config
+	}
+	if s.hostSecrets == nil {
+		hostSecrets, err := utils.ReadHostSecrets(s.HostGitopsDir)
+		if err != nil {
+			return fmt.Errorf("failed to read host secrets: %s", err.Error())
+		}
+		if hostSecrets == nil {
+			hostSecrets = make(map[string]string)
+		}
+		s.hostSecrets = hostSecrets
+	}
+	if s.runningServices == nil {
+		runningServices, err := parseRunningServices()
+		if err != nil {
+			return fmt.Errorf("failed to get running services: %s", err.Error())
+		}
+		s.runningServices = runningServices
+	}
+	return nil
+}
+
+func (s *QuadletSyncer) ReloadUnits() error {
+	return s.applyUnits(nil)
+}
+
+// Checks and applies the staged unit files where the filter returns true, or all of them if the filter is nil, and
+// reloads systemd if any files changed, or if a reload is needed when applying all of them. If the files can't be
+// applied or systemd can't reload them, all the unit files changed during the sync are restored.
+func (s *QuadletSyncer) applyUnits(filter func(path string) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	force := filter == nil && s.reloadNeeded
+	if !s.units.hasPending(filter) && !force {
+		return nil
+	}
+	if err := s.units.validate(fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME"))); err != nil {
+		return err
+	}
+
+	changed, err := s.units.apply(filter)
+	if err == nil && (changed || force) {
+		_, err = utils.RunCommand(s.HostGitopsDir, os.Environ(), false, "systemctl", "--user", "daemon-reload")
+		if err != nil {
+			if restoreErr := s.units.restore(nil); restoreErr != nil {
+				log.WithField("error", restoreErr.Error()).Error("failed to restore unit files")
+			}
+		}
+	}
+	if err != nil {
+		// Reload the restored files
+		_, _ = utils.RunCommand(s.HostGitopsDir, os.Environ(), false, "systemctl", "--user", "daemon-reload")
+		return fmt.Errorf("failed to apply unit files, restored the previous unit files: %s", err.Error())
+	}
+	if filter == nil {
+		s.reloadNeeded = false
+	}
+	return nil
+}
+
+// Restores the unit files changed during the sync, including the image units applied while creating the services, and
+// reloads systemd if any files were restored. With services, only the unit files owned by the services are restored,
+// before or after the sync, and the shared image units are kept.
+func (s *QuadletSyncer) RestoreUnits(services []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.units.hasBackups() {
+		return nil
+	}
+	var filter func(path string, backup *string) bool
+	if services != nil {
+		filter = func(path string, backup *string) bool {
+			content, err := utils.ReadFile(path)
+			for _, service := range services {
+				if (backup != nil && ownedBy(*backup, service)) || (err == nil && ownedBy(content, service)) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	err := s.units.restore(filter)
+	// Reload the files that were restored, even if some of them couldn't be
+	if _, reloadErr := utils.RunCommand(s.HostGitopsDir, os.Environ(), false, "systemctl", "--user", "daemon-reload"); err == nil {
+		err = reloadErr
+	}
+	return err
+}
+
+func (s *QuadletSyncer) RunJobs(service string) error {
+	return runJobs(service)
 }
 
 func (s *QuadletSyncer) RestartService(service string) error {
 	return restartService(service)
 }
 
+func (s *QuadletSyncer) GetRunningConfigHashes() (map[string]string, error) {
+	return parseRunningConfigHashes()
+}
+
+func (s *QuadletSyncer) ReloadService(service string, serviceConfig utils.Service) error {
+	return reloadService(service, serviceConfig)
+}
+
 func (s *QuadletSyncer) StopService(service string) error {
 	return stopService(service)
 }
 
+func (s *QuadletSyncer) Prune() error {
+	quadletDir := fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME"))
+	if err := pruneImageUnits(quadletDir); err != nil {
+		return err
+	}
+	if err := pruneBuiltImages(quadletDir); err != nil {
+		return err
+	}
+	return pruneSecrets(quadletDir)
+}
+
 func (s *QuadletSyncer) RunPre(cmd string) error {
 	_, err := utils.RunCommand(s.HostGitopsDir, os.Environ(), false, "bash", "-c", "--", cmd)
 	return err
@@ -53,13 +205,16 @@ func (s *QuadletSyncer) RunPost(cmd string) error {
 	return s.RunPre(cmd)
 }
 
-// Returns a map of running service name -> service hash
+// Returns a map of running service name -> service hash, from running containers, pods (for kube services) and the
+// timers of jobs
 func parseRunningServices() (map[string]string, error) {
-	services := make(map[string]string)
-
 	type container struct {
 		Labels map[string]string
 	}
+	type pod struct {
+		Labels map[string]string
+		Status string
+	}
 
 	output, err := utils.RunCommand("", os.Environ(), false, "podman", "ps", "--format", "json")
 	if err != nil {
@@ -70,87 +225,623 @@ func parseRunningServices() (map[string]string, error) {
 
 	json.Unmarshal([]byte(output), &containers)
 
+	output, err = utils.RunCommand("", os.Environ(), false, "podman", "pod", "ps", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []pod{}
+
+	json.Unmarshal([]byte(output), &pods)
+
+	labels := []map[string]string{}
 	for i := range containers {
-		service := containers[i].Labels["gitops-service"]
-		hash := containers[i].Labels["gitops-hash"]
+		labels = append(labels, containers[i].Labels)
+	}
+	for i := range pods {
+		labels = append(labels, podLabels(pods[i].Labels, pods[i].Status))
+	}
 
-		if service != "" {
-			services[service] = hash
-		}
+	services := runningServicesFromLabels(labels)
+
+	jobs, err := runningJobs()
+	if err != nil {
+		return nil, err
+	}
+	for service, hash := range jobs {
+		services[service] = hash
 	}
 
 	return services, nil
 }
 
-func createAndPrepareService(hostGitopsDir string, name string, config utils.Service) (string, error) {
+// Returns the labels of a pod that should be used to find the running services. Pods that have stopped are ignored,
+// and pods where only some of the containers are running don't have a hash, so the service is restarted.
+func podLabels(labels map[string]string, status string) map[string]string {
+	switch status {
+	case "Running":
+		return labels
+	case "Degraded":
+		degraded := make(map[string]string)
+		for k, v := range labels {
+			degraded[k] = v
+		}
+		degraded["gitops-hash"] = ""
+		return degraded
+	default:
+		return map[string]string{}
+	}
+}
+
+// Returns a map of running service name -> service hash from the labels of the running containers. If not all the
+// containers of a pod are running, or they have different hashes, the hash is empty so the service is restarted.
+func runningServicesFromLabels(containerLabels []map[string]string) map[string]string {
+	services := make(map[string]string)
+	running := make(map[string]int)
+	expected := make(map[string]int)
+
+	for _, labels := range containerLabels {
+		service := labels["gitops-service"]
+		hash := labels["gitops-hash"]
+
+		// Jobs and init containers run to completion, jobs are running if their timer is active
+		if service == "" || labels["gitops-kind"] != "" {
+			continue
+		}
+
+		if existing, ok := services[service]; ok && existing != hash {
+			hash = ""
+		}
+		services[service] = hash
+		running[service] = running[service] + 1
+		if count, err := strconv.Atoi(labels["gitops-container-count"]); err == nil {
+			expected[service] = count
+		}
+	}
+
+	for service, count := range expected {
+		if running[service] < count {
+			services[service] = ""
+		}
+	}
+
+	return services
+}
+
+// Returns the options to hash the service dir with, and the options for the service hash. Templates are part of the
+// hash through the rendered files instead, also with git hashing, so a template rendering a file that can be reloaded
+// doesn't restart the service. The files that can be reloaded are part of the config hash instead of the service hash,
+// so changing them doesn't restart the service.
+func serviceHashOptions(hashing string, reload utils.Reload, salt []byte, log *log.Entry) (utils.HashOptions, utils.HashOptions) {
+	hashOptions := utils.HashOptions{Exclude: utils.IsTemplateFile, SopsSalt: salt}
+	if hashing == utils.HASHING_GIT {
+		hashOptions.Git = true
+		hashOptions.Log = log
+	}
+	serviceOptions := hashOptions
+	serviceOptions.Ignore = reload.Files
+	return hashOptions, serviceOptions
+}
+
+// Creates the unit files for the service, and returns the service with the service hash, and the hash of the files
+// that can be reloaded and how to reload them
+func (s *QuadletSyncer) createAndPrepareService(name string, config utils.Service) (utils.Service, error) {
 	log := log.WithField("service", name)
+	hostGitopsDir := s.HostGitopsDir
+	s.mu.Lock()
+	hostConfig := *s.hostConfig
+	hostSecrets := s.hostSecrets
+	runningHash := s.runningServices[name]
+	s.mu.Unlock()
 
 	log.Info("updating service")
 
-	serviceDir := fmt.Sprintf("%s/%s", hostGitopsDir, name)
+	serviceDir, err := utils.JoinInside(hostGitopsDir, name)
+	if err != nil {
+		return config, err
+	}
 
-	hash, err := utils.HashDir(serviceDir + "/")
+	salt, err := utils.HashSalt()
 	if err != nil {
-		return "", err
+		return config, err
+	}
+
+	var manifest utils.Manifest
+	unitFile := ""
+	if quadletFile := fmt.Sprintf(utils.SERVICE_QUADLET_FILE, serviceDir); utils.PathExists(quadletFile) {
+		if utils.PathExists(fmt.Sprintf(utils.SERVICE_MANIFEST_FILE, serviceDir)) {
+			return config, fmt.Errorf("service can't have both a manifest and a unit file")
+		}
+		unitFile, err = utils.ReadFile(quadletFile)
+		if err != nil {
+			return config, err
+		}
+		sopsManifest, err := utils.ReadSopsManifest(serviceDir)
+		if err != nil {
+			return config, err
+		}
+		if len(sopsManifest.Sections) > 0 || len(sopsManifest.Containers) > 0 {
+			return config, fmt.Errorf("the sops manifest can only contain secrets when using a unit file")
+		}
+		manifest.Secrets = sopsManifest.Secrets
+	} else {
+		manifest, err = utils.ReadManifest(serviceDir)
+		if err != nil {
+			return config, err
+		}
+	}
+
+	hashOptions, serviceOptions := serviceHashOptions(hostConfig.Hashing, manifest.Reload, salt, log)
+	hash, err := utils.HashDir(serviceDir, serviceOptions)
+	if err != nil {
+		return config, err
+	}
+	// The tree ID only covers the encrypted content of the sops files, so the secrets are added like with content hashing
+	sopsHashes := []string{}
+	if hostConfig.Hashing == utils.HASHING_GIT {
+		// The same as the tree in `git ls-tree HEAD` unless files are excluded
+		log = log.WithField("tree", hash)
+		sopsHashes, err = utils.SopsHashes(serviceDir, serviceOptions)
+		if err != nil {
+			return config, err
+		}
+	}
+	configHashes := []string{}
+	if manifest.Reload.IsSet() {
+		configOptions := hashOptions
+		configOptions.Only = manifest.Reload.Files
+		dirHash, err := utils.HashDir(serviceDir, configOptions)
+		if err != nil {
+			return config, err
+		}
+		configHashes = append(configHashes, dirHash)
+		if hostConfig.Hashing == utils.HASHING_GIT {
+			configSopsHashes, err := utils.SopsHashes(serviceDir, configOptions)
+			if err != nil {
+				return config, err
+			}
+			configHashes = append(configHashes, configSopsHashes...)
+		}
+	}
+
+	secrets, err := serviceSecrets(name, manifest, hostSecrets)
+	if err != nil {
+		return config, err
 	}
 
-	log = log.WithField("hash", hash)
+	secretsDir := fmt.Sprintf(utils.SERVICE_SECRETS_DIR, utils.RuntimeDir(), name)
+	renderedDir := fmt.Sprintf(utils.SERVICE_RENDERED_DIR, utils.RuntimeDir(), name)
+	for _, dir := range []string{secretsDir, renderedDir} {
+		if strings.HasPrefix(dir, hostGitopsDir+"/") {
+			return config, fmt.Errorf("generated dir '%s' can't be inside the gitops repo", dir)
+		}
+		if err := utils.CheckInside(utils.RuntimeDir(), dir); err != nil {
+			return config, err
+		}
+	}
 
-	manifest, err := utils.ReadManifest(serviceDir)
+	err = utils.DecryptServiceFiles(serviceDir, secretsDir)
 	if err != nil {
-		return "", err
+		return config, err
 	}
 
 	templateValues := make(map[string]string)
+	for k, v := range config.Vars {
+		templateValues[k] = v
+	}
 	templateValues["HOST_DIR"] = hostGitopsDir
 	templateValues["SERVICE_DIR"] = serviceDir
+	templateValues["SECRETS_DIR"] = secretsDir
+	templateValues["RENDERED_DIR"] = renderedDir
 	templateValues["SERVICE"] = name
+	templateValues["SHARED_DIR"] = fmt.Sprintf(utils.HOST_SHARED_DIR, hostGitopsDir)
+
+	builtImage, err := buildImageName(serviceDir, name)
+	if err != nil {
+		return config, err
+	}
+	if builtImage != "" {
+		templateValues["BUILD_IMAGE"] = builtImage
+	}
+
+	rendered, err := utils.RenderServiceTemplates(serviceDir, renderedDir, templateValues, secrets)
+	if err != nil {
+		return config, err
+	}
+
+	if unitFile != "" {
+		// Used to find the secrets and images of the service
+		secrets := manifest.Secrets
+		content, err := utils.ReplaceTemplateValues(unitFile, templateValues)
+		if err != nil {
+			return config, err
+		}
+		manifest = manifestFromUnitFile(content)
+		manifest.Secrets = secrets
+	}
+
+	kubeYaml, err := readKubeYaml(serviceDir, rendered)
+	if err != nil {
+		return config, err
+	}
+	if builtImage != "" && unitFile == "" && kubeYaml == "" {
+		defaultToBuildImage(manifest)
+	}
+
+	images, err := manifestImages(manifest, templateValues)
+	if err != nil {
+		return config, err
+	}
+
+	kubeImages := []string{}
+	if kubeYaml != "" {
+		if unitFile != "" || manifest.IsPod() || len(manifest.Container) > 0 {
+			return config, fmt.Errorf("services with a kube yaml can only use the Kube, Unit and Service sections")
+		}
+		_, kubeImages, err = processKubeYaml(kubeYaml, name, "")
+		if err != nil {
+			return config, fmt.Errorf("invalid kube yaml: %s", err.Error())
+		}
+		images = append(images, kubeImages...)
+	}
+
+	pulled := []string{}
+	for _, image := range images {
+		if !skipImageUnit(image, builtImage) {
+			pulled = append(pulled, image)
+		}
+	}
+	imageNames, imageUnitFields := imageUnits(pulled, hostConfig.Images)
+
+	// Containers depend on the image units through Image=, the kube yaml can't reference them so the dependency is
+	// added to the kube unit instead
+	for _, image := range kubeImages {
+		if imageName, ok := imageNames[image]; ok {
+			if manifest.Unit == nil {
+				manifest.Unit = make(map[string][]string)
+			}
+			unit := fmt.Sprintf(IMAGE_SERVICE_UNIT_NAME, imageName)
+			manifest.Unit["Requires"] = append(manifest.Unit["Requires"], unit)
+			manifest.Unit["After"] = append(manifest.Unit["After"], unit)
+		}
+	}
+
+	if config.IsJob() && (manifest.IsPod() || kubeYaml != "") {
+		return config, fmt.Errorf("jobs can only run a single container")
+	}
+	if manifest.Reload.IsSet() && (kubeYaml != "" || config.IsJob()) {
+		return config, fmt.Errorf("reload can't be used for jobs and services with a kube yaml")
+	}
+	if len(manifest.Reload.ExecReload) > 0 {
+		manifest.Service["ExecReload"] = append(manifest.Service["ExecReload"], manifest.Reload.ExecReload...)
+	}
+
+	addInitDependencies(&manifest, name)
+
+	definition := serviceDefinition{manifest: manifest, unitFile: unitFile, kubeYaml: kubeYaml, job: config.IsJob()}
+
+	err = writeImageUnitFiles(imageUnitFields, &s.units)
+	if err != nil {
+		return config, err
+	}
+	digests, err := s.images.digests(imageUnitFields, false, log)
+	if err != nil {
+		return config, err
+	}
+
+	extraHashes, err := prepareSecrets(manifest, secrets, salt, log)
+	if err != nil {
+		return config, err
+	}
+	extraHashes = append(extraHashes, sopsHashes...)
+
+	// Only the shared files the service references are part of the hash, so changing a shared file only restarts the
+	// services that use it
+	texts := append(manifest.Values(), unitFile, kubeYaml)
+	for _, content := range rendered {
+		texts = append(texts, string(content))
+	}
+	sharedHashes, err := utils.HashSharedFiles(templateValues["SHARED_DIR"], utils.SharedReferences(templateValues["SHARED_DIR"], texts...), utils.HashOptions{SopsSalt: salt})
+	if err != nil {
+		return config, err
+	}
+	extraHashes = append(extraHashes, sharedHashes...)
+
+	for rel, content := range rendered {
+		// Rendered files can contain secrets, so they are salted like the decrypted sops files
+		renderedHash := fmt.Sprintf("rendered:%s=%s", rel, utils.SaltedHash(content, salt))
+		if manifest.Reload.Reloadable(rel) {
+			configHashes = append(configHashes, renderedHash)
+		} else {
+			extraHashes = append(extraHashes, renderedHash)
+		}
+	}
+	if config.IsJob() {
+		extraHashes = append(extraHashes, fmt.Sprintf("schedule:%s", config.Schedule))
+	}
+
+	dirHash := hash
+	serviceHash := func(digests map[string]string) string {
+		hashes := append([]string{}, extraHashes...)
+		if config.ImageUpdatesMode() == utils.IMAGE_UPDATES_RESTART {
+			for image, digest := range digests {
+				hashes = append(hashes, fmt.Sprintf("image:%s=%s", image, digest))
+			}
+		}
+		if len(hashes) == 0 {
+			return dirHash
+		}
+		return utils.HashStrings(append(hashes, dirHash)...)
+	}
+	hash = serviceHash(digests)
+
+	// Make sure to pull the images before the service is restarted, to avoid cases where it looks like the container
+	// hasn't startet but it's just pulling the image. Unchanged services use the images that exist, unless the images
+	// are checked for updates, and the hash is updated with the digests of the pulled images.
+	if hash != runningHash || s.CheckImages || len(digests) < len(imageUnitFields) {
+		// Image units that are started to pull the images are applied before the other unit files
+		applyImageUnits := func() error {
+			return s.applyUnits(func(path string) bool { return filepath.Ext(path) == ".image" })
+		}
+		if err := s.images.pull(imageUnitFields, applyImageUnits, log); err != nil {
+			return config, err
+		}
+		digests, err = s.images.digests(imageUnitFields, true, log)
+		if err != nil {
+			return config, err
+		}
+		hash = serviceHash(digests)
+	}
+
+	configHash := ""
+	if manifest.Reload.IsSet() {
+		configHash = utils.HashStrings(configHashes...)
+	}
+
+	log = log.WithField("hash", hash).WithField("configHash", configHash)
+
 	templateValues["HASH"] = hash
 
-	containerFile := generateContainerFile(manifest, name, hash, templateValues)
-	err = os.WriteFile(fmt.Sprintf(CONTAINER_UNIT_FILE_PATH, os.Getenv("HOME"), name), []byte(containerFile), 0640)
+	files, err := generateUnitFiles(name, definition, hash, templateValues)
 	if err != nil {
-		return "", err
+		return config, err
+	}
+	for path, content := range files {
+		if filepath.Ext(path) != ".container" {
+			continue
+		}
+		// Hand written unit files are installed as they are written
+		if definition.unitFile == "" {
+			content = useImageUnits(content, imageNames)
+		}
+		files[path] = addConfigHashLabel(content, configHash)
+	}
+	err = writeServiceUnitFiles(name, files, &s.units)
+	if err != nil {
+		return config, err
+	}
+	// The files on disk can be unchanged while systemd still runs older ones, if an earlier sync failed after writing
+	// them, and restarting the service would then keep the old hash
+	if hash != runningHash || needsDaemonReload(definitionMainUnitName(name, definition), log) {
+		s.mu.Lock()
+		s.reloadNeeded = true
+		s.mu.Unlock()
+	}
+	if config.IsJob() {
+		err = writeJobTimerFile(name, config.Schedule, hash, &s.units, log)
+	} else {
+		err = stageJobTimerRemoval(name, &s.units)
+	}
+	if err != nil {
+		return config, err
+	}
+
+	if builtImage != "" {
+		if err := buildImage(serviceDir, builtImage, log); err != nil {
+			return config, err
+		}
 	}
 
-	_, err = utils.RunCommand(hostGitopsDir, os.Environ(), false, "systemctl", "--user", "daemon-reload")
+	if config.ImageUpdatesMode() == utils.IMAGE_UPDATES_NOTIFY {
+		notifyImageUpdates(name, digests, log)
+	}
+
+	config.Hash = hash
+	config.ConfigHash = configHash
+	config.Reload = manifest.Reload
+	return config, nil
+}
+
+// What the unit files for a service are generated from
+type serviceDefinition struct {
+	manifest utils.Manifest
+	// Hand written container unit file, used instead of the manifest
+	unitFile string
+	// Kubernetes yaml, the service is run as a kube unit if this is set
+	kubeYaml string
+	// The container runs to completion when started by a timer
+	job bool
+}
+
+// Returns the kube yaml of the service, preferring a rendered template, or an empty string if there is none
+func readKubeYaml(serviceDir string, rendered map[string][]byte) (string, error) {
+	if content, ok := rendered[filepath.Base(fmt.Sprintf(utils.SERVICE_KUBE_FILE, ""))]; ok {
+		return string(content), nil
+	}
+	kubeFile := fmt.Sprintf(utils.SERVICE_KUBE_FILE, serviceDir)
+	if !utils.PathExists(kubeFile) {
+		return "", nil
+	}
+	return utils.ReadFile(kubeFile)
+}
+
+// Returns the unit files for the service, its jobs and its init containers, path -> content
+func generateUnitFiles(name string, definition serviceDefinition, hash string, templateValues map[string]string) (map[string]string, error) {
+	files, err := generateServiceUnitFiles(name, definition, hash, templateValues)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	for job := range definition.manifest.Jobs {
+		jobFile, _, err := generateJobFile(definition.manifest.Jobs[job], name, job, templateValues)
+		if err != nil {
+			return nil, fmt.Errorf("job '%s': %s", job, err.Error())
+		}
+		path := fmt.Sprintf(JOB_UNIT_FILE_PATH, os.Getenv("HOME"), name, job)
+		if _, ok := files[path]; ok {
+			return nil, fmt.Errorf("job '%s' has the same unit file as a container", job)
+		}
+		files[path] = jobFile
+	}
+
+	mainUnit := definitionMainUnitName(name, definition)
+	previous := ""
+	for _, container := range utils.SortedKeys(definition.manifest.Init) {
+		initFile, err := generateInitFile(definition.manifest.Init[container], name, container, previous, mainUnit, hash, templateValues)
+		if err != nil {
+			return nil, fmt.Errorf("init container '%s': %s", container, err.Error())
+		}
+		path := fmt.Sprintf(INIT_UNIT_FILE_PATH, os.Getenv("HOME"), name, container)
+		if _, ok := files[path]; ok {
+			return nil, fmt.Errorf("init container '%s' has the same unit file as another container", container)
+		}
+		files[path] = initFile
+		previous = container
 	}
 
-	// Make sure to pull the image so it's available when starting the service later, to avoid cases where it looks like
-	// the container hasn't startet but it's just pulling the image
-	return hash, pullImage(manifest)
+	return files, nil
 }
 
-func pullImage(manifest utils.Manifest) error {
-	for _, image := range manifest.Container["Image"] {
-		_, err := utils.RunCommand("", os.Environ(), false, "podman", "pull", image)
+// Returns the unit files for the service, path -> content
+func generateServiceUnitFiles(name string, definition serviceDefinition, hash string, templateValues map[string]string) (map[string]string, error) {
+	files := make(map[string]string)
+	manifest := definition.manifest
+
+	if definition.kubeYaml != "" {
+		kubeYaml, _, err := processKubeYaml(definition.kubeYaml, name, hash)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		yamlPath := fmt.Sprintf(KUBE_YAML_FILE_PATH, os.Getenv("HOME"), name)
+		kubeFile, err := generateKubeFile(manifest, name, yamlPath, templateValues)
+		if err != nil {
+			return nil, err
+		}
+		files[yamlPath] = kubeYaml
+		files[fmt.Sprintf(KUBE_UNIT_FILE_PATH, os.Getenv("HOME"), name)] = kubeFile
+		return files, nil
 	}
-	return nil
+
+	if !manifest.IsPod() {
+		var containerFile string
+		var err error
+		if definition.unitFile != "" {
+			containerFile, err = generateContainerFileFromUnitFile(definition.unitFile, name, hash, templateValues)
+			if err == nil && definition.job {
+				containerFile, err = injectContainerLabels(containerFile, []string{"gitops-kind=job"})
+			}
+		} else if definition.job {
+			containerFile, err = generateJobContainerFile(manifest, name, hash, templateValues)
+		} else {
+			containerFile, err = generateContainerFile(manifest, name, hash, templateValues)
+		}
+		if err != nil {
+			return nil, err
+		}
+		path, err := containerUnitFilePath(name)
+		if err != nil {
+			return nil, err
+		}
+		files[path] = containerFile
+		return files, nil
+	}
+
+	podFile, err := generatePodFile(manifest, name, templateValues)
+	if err != nil {
+		return nil, err
+	}
+	files[fmt.Sprintf(POD_UNIT_FILE_PATH, os.Getenv("HOME"), name)] = podFile
+
+	for container := range manifest.Containers {
+		containerFile, err := generatePodContainerFile(manifest.Containers[container], name, container, hash, len(manifest.Containers), templateValues)
+		if err != nil {
+			return nil, fmt.Errorf("container '%s': %s", container, err.Error())
+		}
+		files[fmt.Sprintf(POD_CONTAINER_UNIT_FILE_PATH, os.Getenv("HOME"), name, container)] = containerFile
+	}
+
+	return files, nil
+}
+
+// Returns the images used by the containers of the manifest, with the template values replaced
+func manifestImages(manifest utils.Manifest, templateKV map[string]string) ([]string, error) {
+	images := []string{}
+	for _, container := range manifest.ContainerSections() {
+		for _, image := range container["Image"] {
+			image, err := utils.ReplaceTemplateValues(image, templateKV)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// Returns the path of the container unit file, checking that it's inside the quadlet dir
+func containerUnitFilePath(service string) (string, error) {
+	if err := utils.ValidateName("service", service); err != nil {
+		return "", err
+	}
+	path := fmt.Sprintf(CONTAINER_UNIT_FILE_PATH, os.Getenv("HOME"), service)
+	return path, utils.CheckInside(fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME")), path)
 }
 
 func restartService(service string) error {
-	_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "restart", fmt.Sprintf(SERVICE_UNIT_NAME, service))
+	if err := utils.ValidateName("service", service); err != nil {
+		return err
+	}
+	if isJob(service) {
+		return restartJobTimer(service)
+	}
+	_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "restart", mainUnitName(service))
 	return err
 }
 
 func stopService(service string) error {
-	_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "stop", fmt.Sprintf(SERVICE_UNIT_NAME, service))
+	if err := utils.ValidateName("service", service); err != nil {
+		return err
+	}
+	if err := removeJobTimer(service); err != nil {
+		return err
+	}
+	_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "stop", mainUnitName(service))
 	if err != nil {
 		return err
 	}
-	_ = os.Remove(fmt.Sprintf(CONTAINER_UNIT_FILE_PATH, os.Getenv("HOME"), service))
+	unitFiles, err := ownedUnitFiles(service)
+	if err != nil {
+		return err
+	}
+	for _, path := range unitFiles {
+		_ = removeUnitFile(path)
+	}
+	if err := forgetJobs(service); err != nil {
+		return err
+	}
+	if err := removeReloadState(service); err != nil {
+		return err
+	}
+	_ = os.RemoveAll(fmt.Sprintf(utils.SERVICE_SECRETS_DIR, utils.RuntimeDir(), service))
+	_ = os.RemoveAll(fmt.Sprintf(utils.SERVICE_RENDERED_DIR, utils.RuntimeDir(), service))
 	return nil
 }
 
-func generateContainerFile(manifest utils.Manifest, service string, hash string, templateKV map[string]string) string {
-	containerFields := utils.BuildFields(manifest.Container, templateKV)
-	unitFields := utils.BuildFields(manifest.Unit, templateKV)
-	serviceFields := utils.BuildFields(manifest.Service, templateKV)
+func generateContainerFile(manifest utils.Manifest, service string, hash string, templateKV map[string]string) (string, error) {
+	containerFields, unitFields, serviceFields, err := buildContainerSections(manifest.Container, manifest.Unit, manifest.Service, templateKV)
+	if err != nil {
+		return "", err
+	}
 
 	file := fmt.Sprintf(`
 [Install]
@@ -168,11 +859,14 @@ Label=gitops-hash=%s
 %s
 `, containerFields, service, hash, unitFields, serviceFields)
 
-	return file
+	return file, nil
 }
 
-func generateNetworkFile(kvs map[string][]string, networkName string) string {
-	networkFields := utils.BuildFields(kvs, make(map[string]string))
+func generateNetworkFile(kvs map[string][]string, networkName string) (string, error) {
+	networkFields, err := utils.BuildFields(kvs, make(map[string]string))
+	if err != nil {
+		return "", err
+	}
 
 	sha := sha256.New()
 	_, _ = sha.Write([]byte(networkFields))
@@ -185,11 +879,14 @@ Label=gitops-network=%s
 Label=gitops-hash=%s
 `, networkFields, networkName, hash)
 
-	return file
+	return file, nil
 }
 
-func generateVolumeFile(kvs map[string][]string, volumeName string) string {
-	volumeFields := utils.BuildFields(kvs, make(map[string]string))
+func generateVolumeFile(kvs map[string][]string, volumeName string) (string, error) {
+	volumeFields, err := utils.BuildFields(kvs, make(map[string]string))
+	if err != nil {
+		return "", err
+	}
 
 	sha := sha256.New()
 	_, _ = sha.Write([]byte(volumeFields))
@@ -202,5 +899,81 @@ Label=gitops-volume=%s
 Label=gitops-hash=%s
 `, volumeFields, volumeName, hash)
 
-	return file
+	return file, nil
+}
+
+// Returns the Container, Unit and Service sections as unit file fields
+func buildContainerSections(container map[string][]string, unit map[string][]string, service map[string][]string, templateKV map[string]string) (string, string, string, error) {
+	containerFields, err := utils.BuildFields(container, templateKV)
+	if err != nil {
+		return "", "", "", fmt.Errorf("section Container: %s", err.Error())
+	}
+	unitFields, err := utils.BuildFields(unit, templateKV)
+	if err != nil {
+		return "", "", "", fmt.Errorf("section Unit: %s", err.Error())
+	}
+	serviceFields, err := utils.BuildFields(service, templateKV)
+	if err != nil {
+		return "", "", "", fmt.Errorf("section Service: %s", err.Error())
+	}
+	return containerFields, unitFields, serviceFields, nil
+}
+
+func generatePodFile(manifest utils.Manifest, service string, templateKV map[string]string) (string, error) {
+	podFields, err := utils.BuildFields(manifest.Pod, templateKV)
+	if err != nil {
+		return "", fmt.Errorf("section Pod: %s", err.Error())
+	}
+	unitFields, err := utils.BuildFields(manifest.Unit, templateKV)
+	if err != nil {
+		return "", fmt.Errorf("section Unit: %s", err.Error())
+	}
+	serviceFields, err := utils.BuildFields(manifest.Service, templateKV)
+	if err != nil {
+		return "", fmt.Errorf("section Service: %s", err.Error())
+	}
+
+	file := fmt.Sprintf(`%s
+
+[Install]
+WantedBy=default.target
+
+[Pod]
+%s
+
+[Unit]
+%s
+
+[Service]
+%s
+`, fmt.Sprintf(UNIT_FILE_OWNER_COMMENT, service), podFields, unitFields, serviceFields)
+
+	return file, nil
+}
+
+// Generates the unit file for a container in a pod. The containers are started by the pod, and has the number of
+// containers in the pod as a label, so it's possible to see if all of them are running.
+func generatePodContainerFile(container utils.PodContainer, service string, name string, hash string, count int, templateKV map[string]string) (string, error) {
+	containerFields, unitFields, serviceFields, err := buildContainerSections(container.Container, container.Unit, container.Service, templateKV)
+	if err != nil {
+		return "", err
+	}
+
+	file := fmt.Sprintf(`
+[Container]
+%s
+Pod=gitops-%s.pod
+Label=gitops-service=%s
+Label=gitops-hash=%s
+Label=gitops-container=%s
+Label=gitops-container-count=%d
+
+[Unit]
+%s
+
+[Service]
+%s
+`, containerFields, service, service, hash, name, count, unitFields, serviceFields)
+
+	return file, nil
 }
@@ -0,0 +1,170 @@
+package quadlet_syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Relative to home, with service name. Labels can't be changed for running containers, so after a reload the service
+// hash and the config hash that was reloaded are written here.
+var RELOAD_STATE_FILE_PATH = "%s/.local/state/gitops/reload/%s.hash"
+
+// Adds the gitops-config-hash label after the gitops-hash label of the main containers in a container unit file
+func addConfigHashLabel(content string, configHash string) string {
+	if configHash == "" || unitFileLabel(content, "gitops-kind") != "" {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "Label=gitops-hash=") {
+			label := fmt.Sprintf("Label=gitops-config-hash=%s", configHash)
+			return strings.Join(append(lines[:i+1], append([]string{label}, lines[i+1:]...)...), "\n")
+		}
+	}
+	return content
+}
+
+// Returns a map of running service name -> config hash from the labels of the running containers, and the reloads
+// recorded in the state, service name -> "<service hash> <config hash>". The state is only used if the running
+// containers still have the service hash it was written for, otherwise they have been restarted since the reload.
+func runningConfigHashesFromLabels(containerLabels []map[string]string, reloaded map[string]string) map[string]string {
+	services := runningServicesFromLabels(containerLabels)
+
+	configHashes := make(map[string]string)
+	for _, labels := range containerLabels {
+		service := labels["gitops-service"]
+		if service == "" || labels["gitops-kind"] != "" {
+			continue
+		}
+		configHash := labels["gitops-config-hash"]
+		if existing, ok := configHashes[service]; ok && existing != configHash {
+			configHash = ""
+		}
+		configHashes[service] = configHash
+	}
+
+	for service, state := range reloaded {
+		fields := strings.Fields(state)
+		if _, ok := configHashes[service]; ok && len(fields) == 2 && services[service] != "" && fields[0] == services[service] {
+			configHashes[service] = fields[1]
+		}
+	}
+
+	return configHashes
+}
+
+type runningContainer struct {
+	Id     string
+	Labels map[string]string
+}
+
+// Returns a map of running service name -> config hash
+func parseRunningConfigHashes() (map[string]string, error) {
+	output, err := utils.RunCommand("", os.Environ(), false, "podman", "ps", "--filter", "label=gitops-service", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	containers := []runningContainer{}
+	if err := json.Unmarshal([]byte(output), &containers); err != nil {
+		return nil, err
+	}
+
+	labels := []map[string]string{}
+	reloaded := make(map[string]string)
+	for _, container := range containers {
+		labels = append(labels, container.Labels)
+
+		service := container.Labels["gitops-service"]
+		if _, ok := reloaded[service]; ok || utils.ValidateName("service", service) != nil {
+			continue
+		}
+		content, err := os.ReadFile(fmt.Sprintf(RELOAD_STATE_FILE_PATH, os.Getenv("HOME"), service))
+		if err == nil {
+			reloaded[service] = string(content)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return runningConfigHashesFromLabels(labels, reloaded), nil
+}
+
+// Returns the ids of the running containers that should be reloaded
+func reloadTargets(containers []runningContainer, reload utils.Reload) []string {
+	ids := []string{}
+	for _, container := range containers {
+		if container.Labels["gitops-kind"] != "" {
+			continue
+		}
+		if reload.Container != "" && container.Labels["gitops-container"] != reload.Container {
+			continue
+		}
+		ids = append(ids, container.Id)
+	}
+	return ids
+}
+
+// Reloads the files of the service with the method in the manifest, and records the config hash that was reloaded
+func reloadService(service string, config utils.Service) error {
+	log := log.WithField("service", service).WithField("configHash", config.ConfigHash)
+
+	reload := config.Reload
+	if !reload.IsSet() {
+		return fmt.Errorf("service can't be reloaded")
+	}
+
+	if len(reload.ExecReload) > 0 {
+		log.Info("reloading service")
+		_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "reload", fmt.Sprintf(SERVICE_UNIT_NAME, service))
+		if err != nil {
+			return err
+		}
+	} else {
+		output, err := utils.RunCommand("", os.Environ(), false, "podman", "ps", "--filter", fmt.Sprintf("label=gitops-service=%s", service), "--format", "json")
+		if err != nil {
+			return err
+		}
+		containers := []runningContainer{}
+		if err := json.Unmarshal([]byte(output), &containers); err != nil {
+			return err
+		}
+		ids := reloadTargets(containers, reload)
+		if len(ids) == 0 {
+			return fmt.Errorf("no running containers to reload")
+		}
+
+		for _, id := range ids {
+			log := log.WithField("container", id)
+			log.Info("reloading container")
+			if reload.Signal != "" {
+				_, err = utils.RunCommand("", os.Environ(), false, "podman", "kill", "--signal", reload.Signal, id)
+			} else {
+				_, err = utils.RunCommand("", os.Environ(), false, "podman", append([]string{"exec", id}, reload.Exec...)...)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to reload container '%s': %s", id, err.Error())
+			}
+		}
+	}
+
+	path := fmt.Sprintf(RELOAD_STATE_FILE_PATH, os.Getenv("HOME"), service)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(fmt.Sprintf("%s %s", config.Hash, config.ConfigHash)), 0600)
+}
+
+// Removes the reload state of the service
+func removeReloadState(service string) error {
+	err := os.Remove(fmt.Sprintf(RELOAD_STATE_FILE_PATH, os.Getenv("HOME"), service))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
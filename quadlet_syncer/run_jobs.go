@@ -0,0 +1,209 @@
+package quadlet_syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Relative to home, with service name and job name
+var JOB_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s-job-%s.container"
+
+// With service name and job name
+var JOB_SERVICE_UNIT_NAME = "gitops-%s-job-%s.service"
+
+// Relative to home, the hashes the jobs have completed for, service name -> job name -> hashes
+var JOBS_STATE_FILE_PATH = "%s/.local/state/gitops/jobs.json"
+
+// Generates the unit file for a job in the manifest, and returns it with the hash of the job. The hash only depends on
+// the job, so changes to the rest of the service don't make the job run again.
+func generateJobFile(job utils.PodContainer, service string, name string, templateKV map[string]string) (string, string, error) {
+	serviceSection := make(map[string][]string)
+	for k, v := range job.Service {
+		serviceSection[k] = v
+	}
+	if len(serviceSection["Type"]) == 0 {
+		serviceSection["Type"] = []string{"oneshot"}
+	}
+
+	containerFields, unitFields, serviceFields, err := buildContainerSections(job.Container, job.Unit, serviceSection, templateKV)
+	if err != nil {
+		return "", "", err
+	}
+	hash := utils.HashStrings(containerFields, unitFields, serviceFields)
+
+	file := fmt.Sprintf(`
+[Container]
+%s
+Label=gitops-service=%s
+Label=gitops-kind=job
+Label=gitops-job=%s
+Label=gitops-job-hash=%s
+
+[Unit]
+%s
+
+[Service]
+%s
+`, containerFields, service, name, hash, unitFields, serviceFields)
+
+	return file, hash, nil
+}
+
+// Returns the value of the label in the unit file, or an empty string if it isn't set
+func unitFileLabel(content string, label string) string {
+	for _, line := range unitFileLines(content) {
+		prefix := fmt.Sprintf("Label=%s=", label)
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+func readJobsState() (map[string]map[string][]string, error) {
+	state := make(map[string]map[string][]string)
+	content, err := os.ReadFile(fmt.Sprintf(JOBS_STATE_FILE_PATH, os.Getenv("HOME")))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("invalid jobs state: %s", err.Error())
+	}
+	return state, nil
+}
+
+// Returns true if the job has completed for the hash. Every hash is kept, so reverting a job to an earlier version
+// doesn't run it again.
+func jobCompleted(state map[string]map[string][]string, service string, name string, hash string) bool {
+	for _, completed := range state[service][name] {
+		if completed == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes the jobs of the service that are no longer in its manifest from the state, jobs is job name -> hash. Returns
+// true if any jobs were removed.
+func pruneJobsState(state map[string]map[string][]string, service string, jobs map[string]string) bool {
+	pruned := false
+	for name := range state[service] {
+		if _, ok := jobs[name]; !ok {
+			delete(state[service], name)
+			pruned = true
+		}
+	}
+	if _, ok := state[service]; ok && len(state[service]) == 0 {
+		delete(state, service)
+		pruned = true
+	}
+	return pruned
+}
+
+// Writes the state to a temporary file that replaces the state file, so a crash can't leave a partial state
+func writeJobsState(state map[string]map[string][]string) error {
+	path := fmt.Sprintf(JOBS_STATE_FILE_PATH, os.Getenv("HOME"))
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Runs the jobs of the service that haven't completed for their current hash, in the order of their names
+func runJobs(service string) error {
+	files, err := ownedUnitFiles(service)
+	if err != nil {
+		return err
+	}
+
+	state, err := readJobsState()
+	if err != nil {
+		return err
+	}
+
+	jobs := make(map[string]string)
+	for _, path := range files {
+		if !strings.HasPrefix(filepath.Base(path), fmt.Sprintf("gitops-%s-job-", service)) || filepath.Ext(path) != ".container" {
+			continue
+		}
+		content, err := utils.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if name := unitFileLabel(content, "gitops-job"); name != "" {
+			jobs[name] = unitFileLabel(content, "gitops-job-hash")
+		}
+	}
+	if pruneJobsState(state, service, jobs) {
+		if err := writeJobsState(state); err != nil {
+			return err
+		}
+	}
+	if len(jobs) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(jobs))
+	for name := range jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if state[service] == nil {
+		state[service] = make(map[string][]string)
+	}
+
+	for _, name := range names {
+		hash := jobs[name]
+		log := log.WithField("service", service).WithField("job", name).WithField("jobHash", hash)
+
+		if jobCompleted(state, service, name, hash) {
+			log.Info("job has already completed")
+			continue
+		}
+
+		log.Info("running job")
+		_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "start", fmt.Sprintf(JOB_SERVICE_UNIT_NAME, service, name))
+		if err != nil {
+			return fmt.Errorf("job '%s' failed: %s", name, err.Error())
+		}
+		log.Info("job completed")
+
+		state[service][name] = append(state[service][name], hash)
+		if err := writeJobsState(state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the completed jobs of the service from the state, so they run again if the service is added back
+func forgetJobs(service string) error {
+	state, err := readJobsState()
+	if err != nil {
+		return err
+	}
+	if _, ok := state[service]; !ok {
+		return nil
+	}
+	delete(state, service)
+	return writeJobsState(state)
+}
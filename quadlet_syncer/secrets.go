@@ -0,0 +1,198 @@
+package quadlet_syncer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// With service name and secret name
+var SERVICE_SECRET_NAME = "%s-%s"
+
+// Returns the secrets that can be referenced by the service, podman secret name -> value. Secrets from the sops
+// manifest are prefixed with the service name.
+func serviceSecrets(service string, manifest utils.Manifest, hostSecrets map[string]string) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	for name, value := range hostSecrets {
+		secrets[name] = value
+	}
+	for name, value := range manifest.Secrets {
+		name = fmt.Sprintf(SERVICE_SECRET_NAME, service, name)
+		if _, ok := secrets[name]; ok {
+			return nil, fmt.Errorf("secret '%s' is defined both for the host and the service", name)
+		}
+		secrets[name] = value
+	}
+
+	return secrets, nil
+}
+
+// Returns the names of the secrets referenced with `Secret=` in the fields
+func referencedSecrets(fields []string) []string {
+	names := []string{}
+	for _, field := range fields {
+		name := strings.SplitN(field, ",", 2)[0]
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Returns the gitops labels of the secret, or nil if it doesn't exist
+func inspectSecret(name string, log *log.Entry) map[string]string {
+	type secret struct {
+		Spec struct {
+			Labels map[string]string
+		}
+	}
+
+	// Fails if the secret doesn't exist
+	output, err := utils.RunCommandLog(log, "", os.Environ(), "podman", "secret", "inspect", name)
+	if err != nil {
+		return nil
+	}
+
+	secrets := []secret{}
+	if err := json.Unmarshal([]byte(output), &secrets); err != nil || len(secrets) == 0 {
+		return nil
+	}
+	if secrets[0].Spec.Labels == nil {
+		return map[string]string{}
+	}
+	return secrets[0].Spec.Labels
+}
+
+// Host secrets can be used by several services that are created at the same time
+var secretsLock sync.Mutex
+
+// Creates the podman secret, or replaces it if the content has changed. Returns the hash of the secret, which is
+// salted since it's readable in the labels of the secret.
+func ensureSecret(name string, value string, salt []byte, log *log.Entry) (string, error) {
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+
+	log = log.WithField("secret", name)
+
+	hash := utils.SaltedHash([]byte(value), salt)
+
+	labels := inspectSecret(name, log)
+	if labels != nil && labels["gitops-secret"] == "" {
+		return "", fmt.Errorf("secret '%s' already exists, and isn't managed by gitops", name)
+	}
+	if labels != nil && labels["gitops-hash"] == hash {
+		return hash, nil
+	}
+
+	log.Info("creating secret")
+	_, err := utils.RunCommandWithInput(log, "", os.Environ(), []byte(value),
+		"podman", "secret", "create", "--replace",
+		"--label", fmt.Sprintf("gitops-secret=%s", name),
+		"--label", fmt.Sprintf("gitops-hash=%s", hash),
+		name, "-")
+
+	return hash, err
+}
+
+// Creates the secrets referenced by the manifest. Returns the hashes of the secrets, which should be part of the
+// service hash so the service is restarted when a secret is rotated.
+func prepareSecrets(manifest utils.Manifest, secrets map[string]string, salt []byte, log *log.Entry) ([]string, error) {
+	references := []string{}
+	for _, container := range manifest.ContainerSections() {
+		references = append(references, referencedSecrets(container["Secret"])...)
+	}
+
+	hashes := []string{}
+	for _, name := range references {
+		value, ok := secrets[name]
+		if !ok {
+			// Might be a secret created outside of gitops
+			continue
+		}
+		hash, err := ensureSecret(name, value, salt, log)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, fmt.Sprintf("secret:%s=%s", name, hash))
+	}
+
+	return hashes, nil
+}
+
+// Returns the names of the secrets referenced in the gitops unit files
+func unitFileSecrets(quadletDir string) (map[string]struct{}, error) {
+	secrets := make(map[string]struct{})
+
+	files, err := filepath.Glob(fmt.Sprintf("%s/gitops-*.container", quadletDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := utils.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fields := []string{}
+		for _, line := range strings.Split(content, "\n") {
+			if strings.HasPrefix(line, "Secret=") {
+				fields = append(fields, strings.TrimPrefix(line, "Secret="))
+			}
+		}
+		for _, name := range referencedSecrets(fields) {
+			secrets[name] = struct{}{}
+		}
+	}
+
+	return secrets, nil
+}
+
+// Removes gitops secrets that aren't referenced by any unit file
+func pruneSecrets(quadletDir string) error {
+	type secret struct {
+		Name string
+		Spec struct {
+			Name string
+		}
+	}
+
+	output, err := utils.RunCommand("", os.Environ(), false, "podman", "secret", "ls", "--format", "json")
+	if err != nil {
+		return err
+	}
+	secrets := []secret{}
+	if err := json.Unmarshal([]byte(output), &secrets); err != nil {
+		return err
+	}
+
+	referenced, err := unitFileSecrets(quadletDir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range secrets {
+		name := s.Spec.Name
+		if name == "" {
+			name = s.Name
+		}
+		if _, ok := referenced[name]; ok {
+			continue
+		}
+		if labels := inspectSecret(name, log.WithField("secret", name)); labels == nil || labels["gitops-secret"] == "" {
+			continue
+		}
+		_, err := utils.RunCommand("", os.Environ(), false, "podman", "secret", "rm", name)
+		if err != nil {
+			return err
+		}
+		log.WithField("secret", name).Info("removed unused secret")
+	}
+
+	return nil
+}
@@ -1,9 +1,14 @@
 package quadlet_syncer
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
 )
 
 func assert(t *testing.T, v bool, reason string) {
@@ -55,7 +60,10 @@ func TestGenerateContainerFile(t *testing.T) {
 		"CONFIG_DIR": "/config",
 	}
 
-	manifestFile := generateContainerFile(manifest, "test-service", "test-hash", templateKV)
+	manifestFile, err := generateContainerFile(manifest, "test-service", "test-hash", templateKV)
+	if err != nil {
+		t.Fatalf("generating file failed: %s", err.Error())
+	}
 
 	assertEq(t, manifestFile, `
 [Install]
@@ -87,7 +95,10 @@ func TestGenerateNetworkFile(t *testing.T) {
 		"Subnet": {"172.16.0.0/24"},
 	}
 
-	manifestFile := generateNetworkFile(manifest, "test-network")
+	manifestFile, err := generateNetworkFile(manifest, "test-network")
+	if err != nil {
+		t.Fatalf("generating file failed: %s", err.Error())
+	}
 
 	assertEq(t, manifestFile, `
 [Network]
@@ -105,7 +116,10 @@ func TestGenerateVolumeFile(t *testing.T) {
 		"Group": {"root"},
 	}
 
-	manifestFile := generateVolumeFile(manifest, "test-volume")
+	manifestFile, err := generateVolumeFile(manifest, "test-volume")
+	if err != nil {
+		t.Fatalf("generating file failed: %s", err.Error())
+	}
 
 	assertEq(t, manifestFile, `
 [Volume]
@@ -117,3 +131,825 @@ Label=gitops-hash=8dca47a2e34d260922c4a6bd07890238091c260d3abb6dae29c4e675a4e868
 `, "generated network file doesn't match expected output")
 
 }
+
+func TestServiceSecrets(t *testing.T) {
+	manifest := utils.Manifest{
+		Container: map[string][]string{
+			"Secret": {
+				"app-db,type=env,target=DB_PASSWORD",
+				"token",
+			},
+		},
+		Secrets: map[string]string{
+			"db": "password",
+		},
+	}
+
+	secrets, err := serviceSecrets("app", manifest, map[string]string{"token": "abc"})
+	if err != nil {
+		t.Fatalf("serviceSecrets failed: %s", err.Error())
+	}
+	assertEq(t, secrets["app-db"], "password", "service secrets should be prefixed with the service name")
+	assertEq(t, secrets["token"], "abc", "host secrets should be available")
+
+	referenced := referencedSecrets(manifest.Container["Secret"])
+	assertEq(t, len(referenced), 2, "expected two referenced secrets")
+	assertEq(t, referenced[0], "app-db", "options should be stripped from the secret reference")
+	assertEq(t, referenced[1], "token", "expected token to be referenced")
+
+	_, err = serviceSecrets("app", manifest, map[string]string{"app-db": "abc"})
+	assert(t, err != nil, "secret defined for both the host and the service should fail")
+}
+
+func TestGenerateContainerFileFromUnitFile(t *testing.T) {
+	unitFile := `[Unit]
+Description=Caddy
+
+[Container]
+Image=docker.io/library/caddy:2.5.2-alpine
+Volume=${SERVICE_DIR}/Caddyfile:/etc/caddy/Caddyfile:z
+Secret=token,type=env,\
+  target=TOKEN
+
+[X-Custom]
+Key=value
+
+[Install]
+WantedBy=default.target
+`
+
+	templateKV := map[string]string{
+		"SERVICE_DIR": "/gitops/caddy",
+	}
+
+	containerFile, err := generateContainerFileFromUnitFile(unitFile, "test-service", "test-hash", templateKV)
+	if err != nil {
+		t.Fatalf("generating container file failed: %s", err.Error())
+	}
+
+	assertEq(t, containerFile, `[Unit]
+Description=Caddy
+
+[Container]
+Label=gitops-service=test-service
+Label=gitops-hash=test-hash
+Image=docker.io/library/caddy:2.5.2-alpine
+Volume=/gitops/caddy/Caddyfile:/etc/caddy/Caddyfile:z
+Secret=token,type=env,\
+  target=TOKEN
+
+[X-Custom]
+Key=value
+
+[Install]
+WantedBy=default.target
+`, "generated container file doesn't match expected output")
+
+	manifest := manifestFromUnitFile(containerFile)
+	assertEq(t, manifest.Container["Image"][0], "docker.io/library/caddy:2.5.2-alpine", "expected image to be read from the unit file")
+	assertEq(t, manifest.Container["Secret"][0], "token,type=env, target=TOKEN", "expected continued lines to be joined")
+	assertEq(t, manifest.Unit["Description"][0], "Caddy", "expected description to be read from the unit file")
+
+	_, err = generateContainerFileFromUnitFile("[Unit]\n", "test-service", "test-hash", templateKV)
+	assert(t, err != nil, "unit file without a Container section should fail")
+
+	_, err = generateContainerFileFromUnitFile("[Container]\nLabel=gitops-hash=abc\n", "test-service", "test-hash", templateKV)
+	assert(t, err != nil, "unit file setting the gitops-hash label should fail")
+	_, err = generateContainerFileFromUnitFile("[Container]\nLabel=app=caddy \"gitops-service=other\"\n", "test-service", "test-hash", templateKV)
+	assert(t, err != nil, "unit file setting the gitops-service label should fail")
+	_, err = generateContainerFileFromUnitFile("[Container]\nLabel=app=caddy\n", "test-service", "test-hash", templateKV)
+	assert(t, err == nil, "unit file with other labels should be valid")
+}
+
+func TestGeneratePodFiles(t *testing.T) {
+	manifest := utils.Manifest{
+		Pod: map[string][]string{
+			"PublishPort": {"8080:8080"},
+		},
+		Containers: map[string]utils.PodContainer{
+			"app": {
+				Container: map[string][]string{
+					"Image":       {"docker.io/library/app:1"},
+					"Environment": {"REDIS=localhost:6379"},
+				},
+			},
+			"redis": {
+				Container: map[string][]string{
+					"Image": {"docker.io/library/redis:7"},
+				},
+			},
+		},
+		Service: map[string][]string{
+			"Restart": {"always"},
+		},
+	}
+
+	podFile, err := generatePodFile(manifest, "test-service", map[string]string{})
+	if err != nil {
+		t.Fatalf("generating pod file failed: %s", err.Error())
+	}
+
+	assertEq(t, podFile, `# gitops-service=test-service
+
+[Install]
+WantedBy=default.target
+
+[Pod]
+PublishPort=8080:8080
+
+
+[Unit]
+
+
+[Service]
+Restart=always
+
+`, "generated pod file doesn't match expected output")
+
+	containerFile, err := generatePodContainerFile(manifest.Containers["app"], "test-service", "app", "test-hash", 2, map[string]string{})
+	if err != nil {
+		t.Fatalf("generating container file failed: %s", err.Error())
+	}
+
+	assertEq(t, containerFile, `
+[Container]
+Environment=REDIS=localhost:6379
+Image=docker.io/library/app:1
+
+Pod=gitops-test-service.pod
+Label=gitops-service=test-service
+Label=gitops-hash=test-hash
+Label=gitops-container=app
+Label=gitops-container-count=2
+
+[Unit]
+
+
+[Service]
+
+`, "generated container file doesn't match expected output")
+
+	assert(t, ownedBy(podFile, "test-service"), "pod file should be owned by the service")
+	assert(t, ownedBy(containerFile, "test-service"), "container file should be owned by the service")
+	assert(t, !ownedBy(containerFile, "test"), "container file should not be owned by another service")
+}
+
+func TestRunningServicesFromLabels(t *testing.T) {
+	services := runningServicesFromLabels([]map[string]string{
+		{"gitops-service": "service-a", "gitops-hash": "a"},
+		// Pod with all containers running
+		{"gitops-service": "service-b", "gitops-hash": "b", "gitops-container-count": "2"},
+		{"gitops-service": "service-b", "gitops-hash": "b", "gitops-container-count": "2"},
+		// Pod with one container missing
+		{"gitops-service": "service-c", "gitops-hash": "c", "gitops-container-count": "2"},
+		// Pod with containers from different versions
+		{"gitops-service": "service-d", "gitops-hash": "d", "gitops-container-count": "2"},
+		{"gitops-service": "service-d", "gitops-hash": "1", "gitops-container-count": "2"},
+		// Not managed by gitops
+		{"app": "e"},
+	})
+
+	assertEq(t, len(services), 4, "expected four running services")
+	assertEq(t, services["service-a"], "a", "service-a should be running")
+	assertEq(t, services["service-b"], "b", "service-b should be running")
+	assertEq(t, services["service-c"], "", "service-c should be running without a hash")
+	assertEq(t, services["service-d"], "", "service-d should be running without a hash")
+}
+
+func TestUnitServiceName(t *testing.T) {
+	assertEq(t, unitServiceName("/a/gitops-service.container"), "gitops-service.service", "unexpected service name for container")
+	assertEq(t, unitServiceName("/a/gitops-service.pod"), "gitops-service-pod.service", "unexpected service name for pod")
+	assertEq(t, unitServiceName("/a/gitops-service.kube"), "gitops-service.service", "unexpected service name for kube")
+	assertEq(t, unitServiceName("/a/gitops-service.yml"), "", "kube yaml shouldn't have a service")
+}
+
+func TestProcessKubeYaml(t *testing.T) {
+	content, images, err := processKubeYaml(`apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+    - name: app
+      image: docker.io/library/app:1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: value
+`, "test-service", "test-hash")
+	if err != nil {
+		t.Fatalf("processing kube yaml failed: %s", err.Error())
+	}
+
+	assertEq(t, content, `# gitops-service=test-service
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+  labels:
+    gitops-service: test-service
+    gitops-hash: test-hash
+spec:
+  containers:
+    - name: app
+      image: docker.io/library/app:1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: value
+`, "processed kube yaml doesn't match expected output")
+	assertEq(t, strings.Join(images, ","), "docker.io/library/app:1", "unexpected images in kube yaml")
+
+	_, _, err = processKubeYaml(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`, "test-service", "test-hash")
+	assert(t, err != nil, "kube yaml without pods should be rejected")
+}
+
+func TestGenerateKubeFile(t *testing.T) {
+	manifest := utils.Manifest{
+		Kube: map[string][]string{
+			"PublishPort": {"8080:8080"},
+		},
+		Service: map[string][]string{
+			"Restart": {"always"},
+		},
+	}
+
+	kubeFile, err := generateKubeFile(manifest, "test-service", "/a/gitops-test-service.yml", map[string]string{})
+	if err != nil {
+		t.Fatalf("generating kube file failed: %s", err.Error())
+	}
+
+	assertEq(t, kubeFile, `# gitops-service=test-service
+
+[Install]
+WantedBy=default.target
+
+[Kube]
+PublishPort=8080:8080
+Yaml=gitops-test-service.yml
+
+[Unit]
+
+
+[Service]
+Restart=always
+
+`, "generated kube file doesn't match expected output")
+}
+
+func TestPodLabels(t *testing.T) {
+	labels := map[string]string{"gitops-service": "service-a", "gitops-hash": "a"}
+
+	assertEq(t, podLabels(labels, "Running")["gitops-hash"], "a", "running pod should keep its hash")
+	assertEq(t, podLabels(labels, "Degraded")["gitops-hash"], "", "degraded pod shouldn't have a hash")
+	assertEq(t, labels["gitops-hash"], "a", "labels of degraded pod shouldn't be modified")
+	assertEq(t, len(podLabels(labels, "Exited")), 0, "exited pod should be ignored")
+}
+
+func TestBuildImageName(t *testing.T) {
+	serviceDir := t.TempDir()
+
+	image, err := buildImageName(serviceDir, "test-service")
+	assert(t, err == nil, "getting build image name failed")
+	assertEq(t, image, "", "service without Containerfile shouldn't have a build image")
+
+	os.WriteFile(filepath.Join(serviceDir, "Containerfile"), []byte("FROM docker.io/library/alpine\n"), 0600)
+	os.WriteFile(filepath.Join(serviceDir, "manifest.yml"), []byte("Container: {}\n"), 0600)
+
+	image, err = buildImageName(serviceDir, "test-service")
+	assert(t, err == nil, "getting build image name failed")
+	assert(t, strings.HasPrefix(image, "localhost/gitops-test-service:"), "unexpected build image name")
+
+	os.WriteFile(filepath.Join(serviceDir, "manifest.yml"), []byte("Container:\n  Environment:\n    - A=b\n"), 0600)
+	manifestChanged, _ := buildImageName(serviceDir, "test-service")
+	assertEq(t, manifestChanged, image, "changing the manifest shouldn't change the build image")
+
+	os.WriteFile(filepath.Join(serviceDir, "Containerfile"), []byte("FROM docker.io/library/debian\n"), 0600)
+	contextChanged, _ := buildImageName(serviceDir, "test-service")
+	assert(t, contextChanged != image, "changing the build context should change the build image")
+
+	os.WriteFile(filepath.Join(serviceDir, ".gitopsignore"), []byte("app.conf\n"), 0600)
+	os.WriteFile(filepath.Join(serviceDir, "app.conf"), []byte("a\n"), 0600)
+	ignored, _ := buildImageName(serviceDir, "test-service")
+	os.WriteFile(filepath.Join(serviceDir, "app.conf"), []byte("b\n"), 0600)
+	ignoredChanged, _ := buildImageName(serviceDir, "test-service")
+	assert(t, ignoredChanged != ignored, "changing files in .gitopsignore should change the build image, they are in the build context")
+}
+
+func TestUnusedBuiltImages(t *testing.T) {
+	images := []string{"localhost/gitops-a:1111", "localhost/gitops-a:2222", "localhost/gitops-b:3333"}
+	unitFiles := []string{"[Container]\nImage=localhost/gitops-a:2222\n", "[Container]\nImage=localhost/gitops-b:3333\n"}
+
+	unused := unusedBuiltImages(images, unitFiles)
+	assertEq(t, strings.Join(unused, ","), "localhost/gitops-a:1111", "only the images that aren't referenced should be unused")
+}
+
+func TestDefaultToBuildImage(t *testing.T) {
+	manifest := utils.Manifest{
+		Containers: map[string]utils.PodContainer{
+			"app": {
+				Container: map[string][]string{},
+			},
+			"redis": {
+				Container: map[string][]string{
+					"Image": {"docker.io/library/redis:7"},
+				},
+			},
+		},
+	}
+
+	defaultToBuildImage(manifest)
+
+	images, err := manifestImages(manifest, map[string]string{"BUILD_IMAGE": "localhost/gitops-test-service:abc"})
+	assert(t, err == nil, "getting images failed")
+	assertEq(t, strings.Join(images, ","), "localhost/gitops-test-service:abc,docker.io/library/redis:7", "unexpected images")
+}
+
+func TestImageUnits(t *testing.T) {
+	name := implicitImageName("docker.io/library/redis:7")
+	assert(t, strings.HasPrefix(name, "docker-io-library-redis-7-"), "unexpected implicit image name")
+	assert(t, utils.ValidateName("image", name) == nil, "implicit image name should be a valid name")
+	assert(t, utils.ValidateName("image", implicitImageName("registry.example.com/a/very/long/path/to/some/image:with-a-long-tag")) == nil, "long implicit image name should be a valid name")
+
+	names, units := imageUnits([]string{"docker.io/library/redis:7", "docker.io/library/caddy:2"}, map[string]map[string][]string{
+		"caddy": {
+			"Image":    {"docker.io/library/caddy:2"},
+			"AuthFile": {"/etc/auth.json"},
+		},
+	})
+	assertEq(t, names["docker.io/library/caddy:2"], "caddy", "declared image should use its name")
+	assertEq(t, names["docker.io/library/redis:7"], name, "undeclared image should use the implicit name")
+	assertEq(t, len(units), 2, "expected two image units")
+
+	imageFile, err := generateImageFile("caddy", units["caddy"])
+	if err != nil {
+		t.Fatalf("generating image file failed: %s", err.Error())
+	}
+	assertEq(t, imageFile, `# gitops-image=caddy
+
+[Image]
+AuthFile=/etc/auth.json
+Image=docker.io/library/caddy:2
+`, "generated image file doesn't match expected output")
+
+	assertEq(t, useImageUnits("[Container]\nImage=docker.io/library/caddy:2\nImage=localhost/other\n", names),
+		"[Container]\nImage=gitops-caddy.image\nImage=localhost/other\n", "unexpected image references")
+
+	assert(t, skipImageUnit("localhost/gitops-test:abc", "localhost/gitops-test:abc"), "built image shouldn't get an image unit")
+	assert(t, skipImageUnit("other.image", ""), "image unit references shouldn't get an image unit")
+	assert(t, referencesImageUnit("Image=gitops-caddy.image", "caddy", "docker.io/library/caddy:2"), "container should reference image unit")
+	assert(t, referencesImageUnit("Requires=gitops-caddy-image.service", "caddy", "docker.io/library/caddy:2"), "kube unit should reference image unit")
+	assert(t, referencesImageUnit("[Container]\nImage=docker.io/library/caddy:2\n", "caddy", "docker.io/library/caddy:2"), "hand written unit file should reference the image unit by its image")
+	assert(t, !referencesImageUnit("[Container]\nImage=docker.io/library/caddy:3\n", "caddy", "docker.io/library/caddy:2"), "unit file with another image shouldn't reference the image unit")
+}
+
+func TestGenerateJobFiles(t *testing.T) {
+	manifest := utils.Manifest{
+		Container: map[string][]string{
+			"Image": {"docker.io/library/restic:1"},
+		},
+	}
+
+	containerFile, err := generateJobContainerFile(manifest, "test-job", "test-hash", map[string]string{})
+	if err != nil {
+		t.Fatalf("generating job container file failed: %s", err.Error())
+	}
+
+	assertEq(t, containerFile, `
+[Container]
+Image=docker.io/library/restic:1
+
+Label=gitops-service=test-job
+Label=gitops-hash=test-hash
+Label=gitops-kind=job
+
+[Unit]
+
+
+[Service]
+Type=oneshot
+
+`, "generated job container file doesn't match expected output")
+
+	timerFile, err := generateJobTimerFile("test-job", "*-*-* 03:00:00", "test-hash")
+	if err != nil {
+		t.Fatalf("generating timer file failed: %s", err.Error())
+	}
+
+	assertEq(t, timerFile, `# gitops-service=test-job
+# gitops-hash=test-hash
+
+[Unit]
+Description=Timer for gitops job test-job
+
+[Timer]
+OnCalendar=*-*-* 03:00:00
+Persistent=true
+Unit=gitops-test-job.service
+
+[Install]
+WantedBy=timers.target
+`, "generated timer file doesn't match expected output")
+	assertEq(t, timerFileHash(timerFile), "test-hash", "unexpected hash in timer file")
+
+	_, err = generateJobTimerFile("test-job", "daily\nExecStart=/bin/sh", "test-hash")
+	assert(t, err != nil, "schedule with newline should be rejected")
+
+	services := runningServicesFromLabels([]map[string]string{
+		{"gitops-service": "test-job", "gitops-hash": "test-hash", "gitops-kind": "job"},
+	})
+	assertEq(t, len(services), 0, "running job containers shouldn't count as running services")
+}
+
+func TestGenerateJobFile(t *testing.T) {
+	job := utils.PodContainer{
+		Container: map[string][]string{
+			"Image": {"docker.io/library/app:2"},
+			"Exec":  {"migrate"},
+		},
+	}
+
+	jobFile, hash, err := generateJobFile(job, "test-service", "migrate", map[string]string{})
+	if err != nil {
+		t.Fatalf("generating job file failed: %s", err.Error())
+	}
+
+	assertEq(t, jobFile, fmt.Sprintf(`
+[Container]
+Exec=migrate
+Image=docker.io/library/app:2
+
+Label=gitops-service=test-service
+Label=gitops-kind=job
+Label=gitops-job=migrate
+Label=gitops-job-hash=%s
+
+[Unit]
+
+
+[Service]
+Type=oneshot
+
+`, hash), "generated job file doesn't match expected output")
+	assertEq(t, unitFileLabel(jobFile, "gitops-job"), "migrate", "unexpected job label")
+	assertEq(t, unitFileLabel(jobFile, "gitops-job-hash"), hash, "unexpected job hash label")
+
+	_, sameHash, _ := generateJobFile(job, "test-service", "migrate", map[string]string{})
+	assertEq(t, sameHash, hash, "job hash should be deterministic")
+
+	job.Container["Exec"] = []string{"migrate --all"}
+	_, changedHash, _ := generateJobFile(job, "test-service", "migrate", map[string]string{})
+	assert(t, changedHash != hash, "changing the job should change the hash")
+}
+
+func TestJobsState(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	state, err := readJobsState()
+	assert(t, err == nil, "reading missing jobs state should work")
+	assertEq(t, len(state), 0, "missing jobs state should be empty")
+
+	state["service-a"] = map[string][]string{"migrate": {"a", "b"}, "removed": {"c"}}
+	assert(t, writeJobsState(state) == nil, "writing jobs state failed")
+
+	state, err = readJobsState()
+	assert(t, err == nil, "reading jobs state failed")
+	assert(t, jobCompleted(state, "service-a", "migrate", "b"), "jobs state should be persisted")
+	assert(t, jobCompleted(state, "service-a", "migrate", "a"), "old hashes should be kept, so reverting a job doesn't run it again")
+	assert(t, !jobCompleted(state, "service-a", "migrate", "d"), "new hashes shouldn't be completed")
+
+	assert(t, !pruneJobsState(state, "service-a", map[string]string{"migrate": "d", "removed": "c"}), "nothing should be pruned while the jobs exist")
+	assert(t, pruneJobsState(state, "service-a", map[string]string{"migrate": "d"}), "jobs that no longer exist should be pruned")
+	assertEq(t, len(state["service-a"]), 1, "only the removed job should be pruned")
+	assertEq(t, len(state["service-a"]["migrate"]), 2, "old hashes of the remaining jobs should be kept")
+	assert(t, pruneJobsState(state, "service-a", map[string]string{}), "services without jobs should be pruned")
+	assertEq(t, len(state), 0, "services without jobs should be pruned")
+
+	state["service-a"] = map[string][]string{"migrate": {"a"}}
+	assert(t, writeJobsState(state) == nil, "writing jobs state failed")
+	assert(t, forgetJobs("service-a") == nil, "forgetting jobs failed")
+	state, _ = readJobsState()
+	assertEq(t, len(state), 0, "jobs of service-a should be forgotten")
+}
+
+func TestInitContainers(t *testing.T) {
+	manifest := utils.Manifest{
+		Container: map[string][]string{
+			"Image": {"docker.io/library/app:1"},
+		},
+		Init: map[string]utils.PodContainer{
+			"b-wait": {
+				Container: map[string][]string{
+					"Image": {"docker.io/library/busybox:1"},
+				},
+			},
+			"a-permissions": {
+				Container: map[string][]string{
+					"Image": {"docker.io/library/busybox:1"},
+					"Exec":  {"chown -R 1000 /data"},
+				},
+				Unit: map[string][]string{
+					"After": {"network-online.target"},
+				},
+			},
+		},
+	}
+
+	addInitDependencies(&manifest, "test-service")
+	assertEq(t, strings.Join(manifest.Unit["Requires"], ","), "gitops-test-service-init-a-permissions.service,gitops-test-service-init-b-wait.service", "main unit should require the init containers")
+	assertEq(t, strings.Join(manifest.Unit["After"], ","), "gitops-test-service-init-a-permissions.service,gitops-test-service-init-b-wait.service", "main unit should start after the init containers")
+	assertEq(t, definitionMainUnitName("test-service", serviceDefinition{manifest: manifest}), "gitops-test-service.service", "unexpected main unit")
+
+	initFile, err := generateInitFile(manifest.Init["b-wait"], "test-service", "b-wait", "a-permissions", "gitops-test-service.service", "test-hash", map[string]string{})
+	if err != nil {
+		t.Fatalf("generating init file failed: %s", err.Error())
+	}
+
+	assertEq(t, initFile, `
+[Container]
+Image=docker.io/library/busybox:1
+
+Label=gitops-service=test-service
+Label=gitops-hash=test-hash
+Label=gitops-kind=init
+Label=gitops-init=b-wait
+
+[Unit]
+After=gitops-test-service-init-a-permissions.service
+Before=gitops-test-service.service
+PartOf=gitops-test-service.service
+
+
+[Service]
+Type=oneshot
+
+`, "generated init file doesn't match expected output")
+
+	_, err = generateInitFile(manifest.Init["a-permissions"], "test-service", "a-permissions", "", "gitops-test-service.service", "test-hash", map[string]string{})
+	assert(t, err == nil, "generating init file failed")
+	assertEq(t, strings.Join(manifest.Init["a-permissions"].Unit["After"], ","), "network-online.target", "generating init file shouldn't modify the manifest")
+
+	services := runningServicesFromLabels([]map[string]string{
+		{"gitops-service": "test-service", "gitops-hash": "test-hash", "gitops-kind": "init"},
+	})
+	assertEq(t, len(services), 0, "init containers shouldn't count as running services")
+}
+
+func TestUpdatedImages(t *testing.T) {
+	updated := updatedImages(map[string]string{
+		"docker.io/library/app:latest": "sha256:a",
+		"docker.io/library/redis:7":    "sha256:b",
+		"localhost/gitops-app:abc":     "sha256:c",
+	}, map[string]string{
+		"docker.io/library/app:latest": "sha256:new",
+		"docker.io/library/redis:7":    "sha256:b",
+	})
+
+	assertEq(t, len(updated), 1, "expected one updated image")
+	assertEq(t, updated["docker.io/library/app:latest"], "sha256:new", "app should have a new image")
+}
+
+func TestImageDigestCache(t *testing.T) {
+	localDigests := map[string]string{"app:latest": "sha256:old"}
+	pulls := 0
+
+	oldLocalImageDigest, oldPullImageUnit := localImageDigest, pullImageUnit
+	localImageDigest = func(image string, log *log.Entry) (string, bool, error) {
+		digest, ok := localDigests[image]
+		return digest, ok, nil
+	}
+	pullImageUnit = func(name string, fields map[string][]string, exists bool, daemonReload func() error, log *log.Entry) error {
+		pulls++
+		localDigests[fields["Image"][0]] = "sha256:new"
+		return nil
+	}
+	defer func() { localImageDigest, pullImageUnit = oldLocalImageDigest, oldPullImageUnit }()
+
+	units := map[string]map[string][]string{
+		"app":     {"Image": {"app:latest"}},
+		"missing": {"Image": {"missing:latest"}, "Creds": {"user:pass"}},
+	}
+	logger := log.WithField("test", "image-digest-cache")
+	cache := imageDigestCache{}
+
+	digests, err := cache.digests(units, false, logger)
+	assert(t, err == nil, "failed to get digests")
+	assertEq(t, digests["app:latest"], "sha256:old", "expected the digest before the pull")
+	_, ok := digests["missing:latest"]
+	assert(t, !ok, "images that don't exist shouldn't have a digest")
+
+	assert(t, cache.pull(units, func() error { return nil }, logger) == nil, "failed to pull images")
+	assert(t, cache.pull(units, func() error { return nil }, logger) == nil, "failed to pull images again")
+	assertEq(t, pulls, 2, "each image should only be pulled once in a sync")
+
+	digests, err = cache.digests(units, false, logger)
+	assert(t, err == nil, "failed to get digests")
+	assertEq(t, digests["app:latest"], "sha256:old", "services that don't pull should hash the digest before the sync")
+
+	digests, err = cache.digests(units, true, logger)
+	assert(t, err == nil, "failed to get digests")
+	assertEq(t, digests["app:latest"], "sha256:new", "services that pull should hash the pulled digest")
+	assertEq(t, digests["missing:latest"], "sha256:new", "pulled images should have a digest")
+}
+
+func TestReload(t *testing.T) {
+	content := addConfigHashLabel("\n[Container]\nImage=app\nLabel=gitops-service=test-service\nLabel=gitops-hash=test-hash\n", "config-hash")
+	assertEq(t, content, "\n[Container]\nImage=app\nLabel=gitops-service=test-service\nLabel=gitops-hash=test-hash\nLabel=gitops-config-hash=config-hash\n", "config hash label should be added")
+	job := "\n[Container]\nLabel=gitops-hash=test-hash\nLabel=gitops-kind=init\n"
+	assertEq(t, addConfigHashLabel(job, "config-hash"), job, "init containers and jobs shouldn't get the config hash")
+	assertEq(t, addConfigHashLabel(content, ""), content, "services that can't be reloaded shouldn't get the config hash")
+
+	err := reloadService("test-service", utils.Service{ConfigHash: "config-hash"})
+	assert(t, err != nil && err.Error() == "service can't be reloaded", "services without reload should fail with the prepared reload")
+
+	labels := []map[string]string{
+		{"gitops-service": "a", "gitops-hash": "a-hash", "gitops-config-hash": "a-old"},
+		{"gitops-service": "b", "gitops-hash": "b-hash", "gitops-config-hash": "b-old", "gitops-container": "x"},
+		{"gitops-service": "b", "gitops-hash": "b-hash", "gitops-config-hash": "b-other", "gitops-container": "y"},
+		{"gitops-service": "c", "gitops-hash": "c-hash", "gitops-config-hash": "c-old"},
+		{"gitops-service": "c", "gitops-hash": "c-hash", "gitops-kind": "init"},
+	}
+	configHashes := runningConfigHashesFromLabels(labels, map[string]string{
+		"a": "a-hash a-reloaded",
+		// Restarted after the reload
+		"c": "c-previous-hash c-reloaded",
+	})
+	assertEq(t, configHashes["a"], "a-reloaded", "reloaded config hash should be used")
+	assertEq(t, configHashes["b"], "", "containers with different config hashes shouldn't have a config hash")
+	assertEq(t, configHashes["c"], "c-old", "reloads before the service was restarted should be ignored")
+
+	containers := []runningContainer{
+		{Id: "1", Labels: labels[1]},
+		{Id: "2", Labels: labels[2]},
+		{Id: "3", Labels: map[string]string{"gitops-service": "b", "gitops-kind": "job"}},
+	}
+	assertEq(t, strings.Join(reloadTargets(containers, utils.Reload{}), ","), "1,2", "all the containers should be reloaded")
+	assertEq(t, strings.Join(reloadTargets(containers, utils.Reload{Container: "y"}), ","), "2", "only the container should be reloaded")
+}
+
+func TestServiceHashOptions(t *testing.T) {
+	repo := t.TempDir()
+	serviceDir := filepath.Join(repo, "caddy")
+	git := func(args ...string) {
+		_, err := utils.RunCommand(repo, os.Environ(), false, "git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)...)
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, err.Error())
+		}
+	}
+	write := func(file string, content string) {
+		if err := os.MkdirAll(serviceDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(serviceDir, file), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "-A")
+		git("commit", "--quiet", "-m", file)
+	}
+	logger := log.WithField("test", "service-hash-options")
+	reload := utils.Reload{Files: []string{"Caddyfile"}, Signal: "SIGHUP"}
+
+	git("init", "--quiet")
+	write("manifest.yml", "Container: {}\n")
+	write("Caddyfile.tmpl", "a\n")
+
+	hashes := make(map[string]string)
+	for _, hashing := range []string{utils.HASHING_CONTENT, utils.HASHING_GIT} {
+		_, serviceOptions := serviceHashOptions(hashing, reload, []byte("salt"), logger)
+		hash, err := utils.HashDir(serviceDir, serviceOptions)
+		assert(t, err == nil, fmt.Sprintf("hashing with %s failed", hashing))
+		hashes[hashing] = hash
+	}
+
+	write("Caddyfile.tmpl", "b\n")
+	for _, hashing := range []string{utils.HASHING_CONTENT, utils.HASHING_GIT} {
+		_, serviceOptions := serviceHashOptions(hashing, reload, []byte("salt"), logger)
+		hash, err := utils.HashDir(serviceDir, serviceOptions)
+		assert(t, err == nil, fmt.Sprintf("hashing with %s failed", hashing))
+		assertEq(t, hash, hashes[hashing], fmt.Sprintf("templates shouldn't change the service hash with %s hashing", hashing))
+	}
+
+	write("manifest.yml", "Container: {Image: [caddy]}\n")
+	for _, hashing := range []string{utils.HASHING_CONTENT, utils.HASHING_GIT} {
+		_, serviceOptions := serviceHashOptions(hashing, reload, []byte("salt"), logger)
+		hash, err := utils.HashDir(serviceDir, serviceOptions)
+		assert(t, err == nil, fmt.Sprintf("hashing with %s failed", hashing))
+		assert(t, hash != hashes[hashing], fmt.Sprintf("the manifest should change the service hash with %s hashing", hashing))
+	}
+}
+
+func TestWriteServiceUnitFiles(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	quadletDir := fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME"))
+	if err := os.MkdirAll(quadletDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	container := filepath.Join(quadletDir, "gitops-test-service.container")
+	kube := filepath.Join(quadletDir, "gitops-test-service.yml")
+	files := map[string]string{
+		container: "[Container]\nLabel=gitops-service=test-service\n",
+		kube:      "# gitops-service=test-service\n",
+	}
+
+	write := func() bool {
+		tx := &unitTransaction{}
+		err := writeServiceUnitFiles("test-service", files, tx)
+		assert(t, err == nil, "writing unit files failed")
+		changed, err := tx.apply(nil)
+		assert(t, err == nil, "applying unit files failed")
+		return changed
+	}
+
+	assert(t, write(), "new unit files should be written")
+	assert(t, !write(), "unchanged unit files shouldn't be written")
+
+	files[container] = "[Container]\nLabel=gitops-service=test-service\nImage=app\n"
+	assert(t, write(), "changed unit files should be written")
+
+	delete(files, kube)
+	assert(t, write(), "removing unit files should count as a change")
+	assert(t, !utils.PathExists(kube), "unit file that is no longer used should be removed")
+}
+
+func TestUnitTransaction(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.container")
+	added := filepath.Join(dir, "added.container")
+	removed := filepath.Join(dir, "removed.container")
+	if err := os.WriteFile(existing, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(removed, []byte("removed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := &unitTransaction{}
+	assert(t, tx.write(added, "added") == nil, "staging a file failed")
+	assert(t, tx.write(added, "added") == nil, "staging the same content twice should be allowed")
+	assert(t, tx.write(added, "other") != nil, "staging different content for the same file should fail")
+	assert(t, tx.write(existing, "new") == nil, "staging a file failed")
+	tx.remove(removed, func() error { return fmt.Errorf("failed to stop unit") })
+
+	assert(t, tx.hasPending(func(path string) bool { return path == added }), "file should be pending")
+	assert(t, !tx.hasPending(func(path string) bool { return path == "other" }), "file shouldn't be pending")
+
+	_, err := tx.apply(nil)
+	assert(t, err != nil, "applying should fail when a unit can't be stopped")
+
+	content, _ := utils.ReadFile(existing)
+	assertEq(t, content, "old", "file should be restored")
+	assert(t, !utils.PathExists(added), "added file should be removed when restoring")
+	content, _ = utils.ReadFile(removed)
+	assertEq(t, content, "removed", "removed file should be restored")
+
+	tx = &unitTransaction{}
+	tx.write(existing, "new")
+	tx.remove(removed, nil)
+	changed, err := tx.apply(nil)
+	assert(t, err == nil, "applying failed")
+	assert(t, changed, "files should be changed")
+	content, _ = utils.ReadFile(existing)
+	assertEq(t, content, "new", "file should be written")
+	assert(t, !utils.PathExists(removed), "removed file should be removed")
+
+	entries, _ := os.ReadDir(dir)
+	assertEq(t, len(entries), 1, "temporary files should be removed")
+
+	assert(t, tx.hasBackups(), "changed files should be restorable")
+	assert(t, tx.restore(func(path string, backup *string) bool { return *backup == "removed" }) == nil, "restoring failed")
+	assert(t, utils.PathExists(removed), "removed file should be restored")
+	content, _ = utils.ReadFile(existing)
+	assertEq(t, content, "new", "files not matching the filter shouldn't be restored")
+	assert(t, tx.restore(nil) == nil, "restoring failed")
+	content, _ = utils.ReadFile(existing)
+	assertEq(t, content, "old", "file should be restored")
+	assert(t, !tx.hasBackups(), "restored files shouldn't be restored again")
+}
+
+func TestQuadletBinary(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "quadlet")
+	defer func(binaries []string) { QUADLET_BINARIES = binaries }(QUADLET_BINARIES)
+
+	QUADLET_BINARIES = []string{filepath.Join(dir, "missing"), binary}
+	assertEq(t, quadletBinary(), "", "missing quadlet generator should be empty")
+
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, quadletBinary(), binary, "quadlet generator should be found in the other paths")
+
+	tx := &unitTransaction{}
+	assert(t, tx.validate(dir) != nil, "unit files should be checked with the quadlet generator that is found")
+}
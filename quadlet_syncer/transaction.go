@@ -0,0 +1,289 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Paths where distributions install the quadlet generator. If it exists, the unit files are checked with it before
+// they are applied.
+var QUADLET_BINARIES = []string{"/usr/libexec/podman/quadlet", "/usr/lib/podman/quadlet"}
+
+// Returns the path of the quadlet generator, or an empty string if it isn't installed
+func quadletBinary() string {
+	for _, path := range QUADLET_BINARIES {
+		if utils.PathExists(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// The unit file changes of a sync. The services stage their unit files while they are created, and the files are
+// applied together when all the services have been created, so a service that fails doesn't leave a mix of old and
+// new unit files. If applying the files fails, the files that were changed are restored.
+type unitTransaction struct {
+	mu sync.Mutex
+
+	// Path -> content
+	writes map[string]string
+	// Path -> function that stops the unit before the file is removed, can be nil
+	removals map[string]func() error
+
+	// The content of the files before they were changed by the transaction, nil for files that didn't exist
+	backups map[string]*string
+
+	// The missing quadlet generator is only logged once per sync
+	warnedNoQuadlet bool
+}
+
+// Stages a unit file. Services can stage the same file, like image units, as long as they generate the same content.
+func (tx *unitTransaction) write(path string, content string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.writes == nil {
+		tx.writes = make(map[string]string)
+	}
+	if existing, ok := tx.writes[path]; ok && existing != content {
+		return fmt.Errorf("unit file '%s' is generated differently by two services", path)
+	}
+	tx.writes[path] = content
+	return nil
+}
+
+// Stages the removal of a unit file, stop is called before the file is removed
+func (tx *unitTransaction) remove(path string, stop func() error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.removals == nil {
+		tx.removals = make(map[string]func() error)
+	}
+	tx.removals[path] = stop
+}
+
+// Returns true if there are staged files where the filter returns true
+func (tx *unitTransaction) hasPending(filter func(path string) bool) bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	writes, removals := tx.pending(filter)
+	return len(writes) > 0 || len(removals) > 0
+}
+
+// Returns the staged files where the filter returns true, or all of them if the filter is nil
+func (tx *unitTransaction) pending(filter func(path string) bool) ([]string, []string) {
+	writes := []string{}
+	for path := range tx.writes {
+		if filter == nil || filter(path) {
+			writes = append(writes, path)
+		}
+	}
+	removals := []string{}
+	for path := range tx.removals {
+		if filter == nil || filter(path) {
+			removals = append(removals, path)
+		}
+	}
+	sort.Strings(writes)
+	sort.Strings(removals)
+	return writes, removals
+}
+
+// Checks the unit files with the quadlet generator, with the staged changes applied to a copy of the quadlet dir
+func (tx *unitTransaction) validate(quadletDir string) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	binary := quadletBinary()
+	if binary == "" {
+		if !tx.warnedNoQuadlet {
+			log.WithField("paths", QUADLET_BINARIES).Warn("quadlet generator not found, the unit files are applied without checking them")
+			tx.warnedNoQuadlet = true
+		}
+		return nil
+	}
+
+	dir, err := os.MkdirTemp("", "gitops-units-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	entries, err := os.ReadDir(quadletDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(quadletDir, entry.Name())
+		if _, ok := tx.removals[path]; ok || !entry.Type().IsRegular() {
+			continue
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, entry.Name()), content, 0600); err != nil {
+			return err
+		}
+	}
+	for path, content := range tx.writes {
+		if filepath.Dir(path) != quadletDir {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(path)), []byte(content), 0600); err != nil {
+			return err
+		}
+	}
+
+	env := append(os.Environ(), fmt.Sprintf("QUADLET_UNIT_DIRS=%s", dir))
+	if _, err := utils.RunCommand("", env, false, binary, "-dryrun", "-user"); err != nil {
+		return fmt.Errorf("invalid unit files: %s", err.Error())
+	}
+	return nil
+}
+
+// Applies the staged files where the filter returns true, or all of them if the filter is nil. Returns true if any
+// files were changed. The files are written to a temporary file that replaces the unit file, so a crash can't leave a
+// partial unit file. If a file can't be applied, all the files changed by the transaction are restored.
+func (tx *unitTransaction) apply(filter func(path string) bool) (bool, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.backups == nil {
+		tx.backups = make(map[string]*string)
+	}
+
+	writes, removals := tx.pending(filter)
+	err := tx.applyFiles(writes, removals)
+	if err != nil {
+		if restoreErr := tx.restoreFiles(nil); restoreErr != nil {
+			log.WithField("error", restoreErr.Error()).Error("failed to restore unit files")
+		}
+	}
+	return len(writes) > 0 || len(removals) > 0, err
+}
+
+func (tx *unitTransaction) applyFiles(writes []string, removals []string) error {
+	for _, path := range writes {
+		content := tx.writes[path]
+		delete(tx.writes, path)
+
+		existing, err := utils.ReadFile(path)
+		if err == nil && existing == content {
+			continue
+		}
+		if _, ok := tx.backups[path]; !ok {
+			if err == nil {
+				tx.backups[path] = &existing
+			} else if os.IsNotExist(err) {
+				tx.backups[path] = nil
+			} else {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, content); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range removals {
+		stop := tx.removals[path]
+		delete(tx.removals, path)
+
+		existing, err := utils.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := tx.backups[path]; !ok {
+			tx.backups[path] = &existing
+		}
+		if stop != nil {
+			if err := stop(); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns true if files have been changed by the transaction, and not restored
+func (tx *unitTransaction) hasBackups() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return len(tx.backups) > 0
+}
+
+// Restores the files changed by the transaction to their content before the transaction, only the files where the
+// filter returns true if it isn't nil. The filter gets the content before the transaction, nil if the file didn't exist.
+func (tx *unitTransaction) restore(filter func(path string, backup *string) bool) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	return tx.restoreFiles(filter)
+}
+
+func (tx *unitTransaction) restoreFiles(filter func(path string, backup *string) bool) error {
+	paths := []string{}
+	for path, backup := range tx.backups {
+		if filter == nil || filter(path, backup) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		log.WithField("file", path).Warn("restoring unit file")
+		var err error
+		if content := tx.backups[path]; content == nil {
+			err = os.Remove(path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = writeFileAtomic(path, *content)
+		}
+		if err != nil {
+			return err
+		}
+		delete(tx.backups, path)
+	}
+	return nil
+}
+
+// Writes the file to a temporary file in the same directory, that is renamed to replace the file
+func writeFileAtomic(path string, content string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), fmt.Sprintf(".%s.*.tmp", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(0640); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,106 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+)
+
+// Reads the Container, Unit and Service sections of a unit file into a manifest, so it can be used the same way as a
+// manifest when preparing the service. Other sections are ignored.
+func manifestFromUnitFile(content string) utils.Manifest {
+	manifest := utils.Manifest{
+		Container: make(map[string][]string),
+		Unit:      make(map[string][]string),
+		Service:   make(map[string][]string),
+	}
+	sections := map[string]map[string][]string{
+		"Container": manifest.Container,
+		"Unit":      manifest.Unit,
+		"Service":   manifest.Service,
+	}
+
+	var section map[string][]string
+	for _, line := range unitFileLines(content) {
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = sections[strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")]
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if section == nil || len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		section[key] = append(section[key], strings.TrimSpace(kv[1]))
+	}
+
+	return manifest
+}
+
+// Returns the lines of the unit file without comments and empty lines, with continued lines joined
+func unitFileLines(content string) []string {
+	lines := []string{}
+	current := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if current == "" && (line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";")) {
+			continue
+		}
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		lines = append(lines, current+line)
+		current = ""
+	}
+	if current != "" {
+		lines = append(lines, current)
+	}
+	return lines
+}
+
+// Adds the labels at the start of the first Container section, leaving the rest of the file as it is
+func injectContainerLabels(content string, labels []string) (string, error) {
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "[Container]" {
+			continue
+		}
+		injected := append([]string{}, lines[:i+1]...)
+		for _, label := range labels {
+			injected = append(injected, fmt.Sprintf("Label=%s", label))
+		}
+		injected = append(injected, lines[i+1:]...)
+		return strings.Join(injected, "\n"), nil
+	}
+	return "", fmt.Errorf("unit file doesn't have a Container section")
+}
+
+// Returns an error if the unit file sets any of the gitops labels, which are added when the file is installed
+func checkUnitFileLabels(content string) error {
+	for _, value := range manifestFromUnitFile(content).Container["Label"] {
+		for _, label := range strings.Fields(value) {
+			label = strings.Trim(label, `"'`)
+			if strings.HasPrefix(label, "gitops-") {
+				return fmt.Errorf("unit file can't set the label '%s', gitops labels are added when it's installed", strings.SplitN(label, "=", 2)[0])
+			}
+		}
+	}
+	return nil
+}
+
+// Generates the container file from a hand written unit file, with the gitops labels added
+func generateContainerFileFromUnitFile(content string, service string, hash string, templateKV map[string]string) (string, error) {
+	content, err := utils.ReplaceTemplateValues(content, templateKV)
+	if err != nil {
+		return "", err
+	}
+	if err := checkUnitFileLabels(content); err != nil {
+		return "", err
+	}
+	return injectContainerLabels(content, []string{
+		fmt.Sprintf("gitops-service=%s", service),
+		fmt.Sprintf("gitops-hash=%s", hash),
+	})
+}
@@ -0,0 +1,148 @@
+package quadlet_syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/JonasBak/homelab-gitops/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// Relative to home, with service name
+var POD_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s.pod"
+
+// Relative to home, with service name and container name
+var POD_CONTAINER_UNIT_FILE_PATH = "%s/.config/containers/systemd/gitops-%s-%s.container"
+
+// With service name, quadlet adds -pod to the name of the service for pods
+var POD_SERVICE_UNIT_NAME = "gitops-%s-pod.service"
+
+// Comment added to generated unit files that doesn't have a gitops-service label, with service name
+var UNIT_FILE_OWNER_COMMENT = "# gitops-service=%s"
+
+// Returns true if the unit file was generated for the service
+func ownedBy(content string, service string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == fmt.Sprintf("Label=gitops-service=%s", service) || line == fmt.Sprintf(UNIT_FILE_OWNER_COMMENT, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the paths of the unit files generated for the service
+func ownedUnitFiles(service string) ([]string, error) {
+	files, err := filepath.Glob(fmt.Sprintf("%s/gitops-%s*", fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME")), service))
+	if err != nil {
+		return nil, err
+	}
+
+	owned := []string{}
+	for _, file := range files {
+		content, err := utils.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if ownedBy(content, service) {
+			owned = append(owned, file)
+		}
+	}
+	sort.Strings(owned)
+
+	return owned, nil
+}
+
+// Returns the name of the systemd service quadlet generates for the unit file, or an empty string for files that
+// aren't units, like kube yaml
+func unitServiceName(path string) string {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext)
+	switch ext {
+	case ".container", ".kube":
+		return name + ".service"
+	case ".pod", ".image", ".build", ".network", ".volume":
+		return fmt.Sprintf("%s-%s.service", name, strings.TrimPrefix(ext, "."))
+	default:
+		return ""
+	}
+}
+
+// Returns the name of the systemd service that starts and stops the service
+func mainUnitName(service string) string {
+	if utils.PathExists(fmt.Sprintf(POD_UNIT_FILE_PATH, os.Getenv("HOME"), service)) {
+		return fmt.Sprintf(POD_SERVICE_UNIT_NAME, service)
+	}
+	return fmt.Sprintf(SERVICE_UNIT_NAME, service)
+}
+
+// Returns true if systemd reports that the unit file has changed since it was loaded
+func needsDaemonReload(unit string, log *log.Entry) bool {
+	output, err := utils.RunCommandLog(log, "", os.Environ(), "systemctl", "--user", "show", "--property", "NeedDaemonReload", "--value", unit)
+	return err == nil && strings.TrimSpace(output) == "yes"
+}
+
+// Stops the systemd service of the unit file, and removes it
+func removeUnitFile(path string) error {
+	if stop := stopUnitFunc(path); stop != nil {
+		if err := stop(); err != nil {
+			return err
+		}
+	}
+	return os.Remove(path)
+}
+
+// Returns a function that stops the systemd service of the unit file, or nil for files that aren't units
+func stopUnitFunc(path string) func() error {
+	unit := unitServiceName(path)
+	if unit == "" {
+		return nil
+	}
+	return func() error {
+		_, err := utils.RunCommand("", os.Environ(), false, "systemctl", "--user", "stop", unit)
+		return err
+	}
+}
+
+// Stages the unit files for the service that don't exist or have changed, path -> content, and the removal of unit
+// files that were generated for the service earlier but aren't part of it anymore
+func writeServiceUnitFiles(service string, files map[string]string, tx *unitTransaction) error {
+	quadletDir := fmt.Sprintf(QUADLET_DIR, os.Getenv("HOME"))
+
+	for path := range files {
+		if err := utils.CheckInside(quadletDir, path); err != nil {
+			return err
+		}
+		// Unit files for containers in pods can have the same name as the unit file for another service
+		if existing, err := utils.ReadFile(path); err == nil && !ownedBy(existing, service) {
+			return fmt.Errorf("unit file '%s' already exists, and wasn't generated for the service", path)
+		}
+	}
+
+	for path, content := range files {
+		if existing, err := utils.ReadFile(path); err == nil && existing == content {
+			continue
+		}
+		if err := tx.write(path, content); err != nil {
+			return err
+		}
+	}
+
+	owned, err := ownedUnitFiles(service)
+	if err != nil {
+		return err
+	}
+	for _, path := range owned {
+		if _, ok := files[path]; ok {
+			continue
+		}
+		log.WithField("service", service).WithField("file", path).Info("removing unit file that is no longer used")
+		tx.remove(path, stopUnitFunc(path))
+	}
+
+	return nil
+}
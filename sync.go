@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/JonasBak/homelab-gitops/utils"
@@ -48,6 +50,9 @@ func fetch(gitopsRepo string, gitopsRepoDir string) (string, string) {
 	utils.RunCommand(gitopsRepoDir, environ, true, "git", "verify-commit", "-v", "HEAD")
 
 	hostname := os.Getenv("HOSTNAME")
+	if err := utils.ValidateHostname(hostname); err != nil {
+		log.Fatal(err.Error())
+	}
 
 	hostGitopsDir := fmt.Sprintf("%s/gitops/%s", gitopsRepoDir, hostname)
 
@@ -68,7 +73,14 @@ func (err *SyncError) Error() string {
 
 // Start/restart configured services
 func servicesUp(syncer utils.ServiceSyncer) *SyncError {
-	config := syncer.GetConfig()
+	config, err := syncer.GetConfig()
+	if err != nil {
+		return &SyncError{err: fmt.Errorf("failed to read config: %s", err.Error())}
+	}
+
+	if err := config.Validate(); err != nil {
+		return &SyncError{err: fmt.Errorf("invalid config: %s", err.Error())}
+	}
 
 	if config.Pre != nil {
 		log.Info("running pre script")
@@ -82,27 +94,67 @@ func servicesUp(syncer utils.ServiceSyncer) *SyncError {
 	if err != nil {
 		return &SyncError{err: fmt.Errorf("failed to get running containers: %s", err.Error())}
 	}
+	// Used to bring the services back to the previous unit files if the sync fails
+	runningBefore := make(map[string]string)
+	for service, hash := range runningServices {
+		runningBefore[service] = hash
+	}
 
 	log.Info("creating services")
-	for service := range config.Services {
-		log := log.WithField("service", service)
-
-		hash, err := syncer.CreateService(service, config.Services[service])
-		if err != nil {
-			// TODO Should a bad manifest cause the rollout to stop, or should the other services be started?
-			return &SyncError{err: fmt.Errorf("failed to create service: %s", err.Error()), servicesErrored: []string{service}}
+	created, createFailed := createServices(syncer, config.Services, runningServices, config.WorkerCount())
+	if len(createFailed) > 0 {
+		// TODO Should a bad manifest cause the rollout to stop, or should the other services be started?
+		servicesErrored := []string{}
+		for service := range createFailed {
+			servicesErrored = append(servicesErrored, service)
 		}
-		s := config.Services[service]
-		s.Hash = hash
+		sort.Strings(servicesErrored)
+		// Image units are applied while the services are created, before the other unit files
+		if err := syncer.RestoreUnits(nil); err != nil {
+			log.WithField("error", err.Error()).Error("failed to restore unit files")
+		}
+		return &SyncError{err: fmt.Errorf("failed to create service: %s", createFailed[servicesErrored[0]].Error()), servicesErrored: servicesErrored}
+	}
+	for service, s := range created {
 		config.Services[service] = s
+	}
 
-		oldHash := runningServices[service]
-		log = log.WithField("oldHash", oldHash).WithField("newHash", hash)
+	if err := syncer.ReloadUnits(); err != nil {
+		return &SyncError{err: fmt.Errorf("failed to reload unit files: %s", err.Error())}
+	}
 
-		log.Info("service created")
-		if oldHash != hash {
-			log.Info("service changed")
+	// Services with failed jobs aren't restarted, so they are left out of the updated services
+	jobsFailed := []string{}
+	withoutFailedJobs := func(services []string) []string {
+		filtered := []string{}
+		for _, service := range services {
+			failed := false
+			for _, f := range jobsFailed {
+				failed = failed || f == service
+			}
+			if !failed {
+				filtered = append(filtered, service)
+			}
+		}
+		return filtered
+	}
+
+	// Services where only the files that can be reloaded have changed are reloaded instead of restarted
+	runningConfigHashes, err := syncer.GetRunningConfigHashes()
+	if err != nil {
+		return &SyncError{err: fmt.Errorf("failed to get running config hashes: %s", err.Error())}
+	}
+	reloadFailed := []string{}
+	for _, service := range getReloadedServices(config, runningServices, runningConfigHashes) {
+		log := log.WithField("service", service).WithField("oldConfigHash", runningConfigHashes[service]).WithField("newConfigHash", config.Services[service].ConfigHash)
+
+		log.Info("reloading service")
+		if err := syncer.ReloadService(service, config.Services[service]); err != nil {
+			log.WithField("error", err.Error()).Errorf("failed to reload service")
+			reloadFailed = append(reloadFailed, service)
+			continue
 		}
+		log.Info("service reloaded")
 	}
 
 	updatedServices := getUpdatedServices(config, runningServices)
@@ -117,6 +169,7 @@ func servicesUp(syncer utils.ServiceSyncer) *SyncError {
 
 		// Could increase this to attempt to start each service more than once
 		if restartAttempts[service] > 0 {
+			rollbackServices(syncer, runningBefore, nil)
 			return &SyncError{err: fmt.Errorf("some services failed to start"), servicesErrored: updatedServices}
 		}
 		restartAttempts[service] = restartAttempts[service] + 1
@@ -124,6 +177,14 @@ func servicesUp(syncer utils.ServiceSyncer) *SyncError {
 		newHash := config.Services[service].Hash
 		oldHash := runningServices[service]
 		log := log.WithField("service", service).WithField("oldHash", oldHash).WithField("newHash", newHash)
+
+		if err := syncer.RunJobs(service); err != nil {
+			log.WithField("error", err.Error()).Errorf("job failed, not restarting service")
+			jobsFailed = append(jobsFailed, service)
+			updatedServices = withoutFailedJobs(updatedServices)
+			continue
+		}
+
 		log.Info("restarting service")
 		err := syncer.RestartService(service)
 		if err != nil {
@@ -133,20 +194,36 @@ func servicesUp(syncer utils.ServiceSyncer) *SyncError {
 		time.Sleep(3 * time.Second)
 		// starting one service might have automatically started dependencies, so we need to get an updated list
 		runningServices, _ = syncer.GetRunningServices()
-		updatedServices = getUpdatedServices(config, runningServices)
+		updatedServices = withoutFailedJobs(getUpdatedServices(config, runningServices))
 	}
 
 	// Wait a bit to see if containers still run
 	time.Sleep(4 * time.Second)
 	runningServices, _ = syncer.GetRunningServices()
-	if servicesNotUpdated := getUpdatedServices(config, runningServices); len(servicesNotUpdated) != 0 {
+	servicesNotUpdated := withoutFailedJobs(getUpdatedServices(config, runningServices))
+	if len(jobsFailed) > 0 {
+		// The other services have been updated, so only the services with failed jobs are rolled back, unless other
+		// services didn't start either
+		rollback := jobsFailed
+		if len(servicesNotUpdated) != 0 {
+			rollback = nil
+		}
+		rollbackServices(syncer, runningBefore, rollback)
+		return &SyncError{err: fmt.Errorf("jobs failed for some services"), servicesErrored: append(jobsFailed, servicesNotUpdated...)}
+	}
+	if len(servicesNotUpdated) != 0 {
+		rollbackServices(syncer, runningBefore, nil)
 		return &SyncError{err: fmt.Errorf("some services didn't start properly"), servicesErrored: servicesNotUpdated}
 	}
+	if len(reloadFailed) > 0 {
+		return &SyncError{err: fmt.Errorf("failed to reload some services"), servicesErrored: reloadFailed}
+	}
 
 	if config.Post != nil {
 		log.Info("running post script")
 		err := syncer.RunPost(config.Post.Script)
 		if err != nil {
+			rollbackServices(syncer, runningBefore, nil)
 			return &SyncError{err: fmt.Errorf("post script failed: %s", err.Error())}
 		}
 	}
@@ -155,9 +232,123 @@ func servicesUp(syncer utils.ServiceSyncer) *SyncError {
 	return nil
 }
 
-// Stop orphaned services
-func orphansDown(syncer utils.ServiceSyncer) *SyncError {
-	config := syncer.GetConfig()
+// Restores the unit files from before the sync, and brings the services that changed during the sync back to them.
+// Services that weren't running before the sync are stopped before their unit files are removed, and the others are
+// restarted with the restored unit files. With services, only those services are rolled back, otherwise all of them.
+// Only the unit files are restored, the secrets, decrypted files and rendered templates of the services keep the
+// versions from the sync. Errors are logged, since the sync has already failed.
+func rollbackServices(syncer utils.ServiceSyncer, runningBefore map[string]string, services []string) {
+	log.WithField("services", services).Warn("rolling back to the previous unit files")
+
+	rollbackSet := make(map[string]struct{})
+	for _, service := range services {
+		rollbackSet[service] = struct{}{}
+	}
+	changedServices := []string{}
+	runningServices, err := syncer.GetRunningServices()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("failed to get running containers, only restoring the unit files")
+	} else {
+		for _, service := range getChangedServices(runningBefore, runningServices) {
+			if _, ok := rollbackSet[service]; ok || services == nil {
+				changedServices = append(changedServices, service)
+			}
+		}
+	}
+
+	for _, service := range changedServices {
+		if _, ok := runningBefore[service]; ok {
+			continue
+		}
+		if _, ok := runningServices[service]; !ok {
+			continue
+		}
+		log := log.WithField("service", service)
+		if err := syncer.StopService(service); err != nil {
+			log.WithField("error", err.Error()).Error("failed to stop new service")
+			continue
+		}
+		log.Info("stopped new service")
+	}
+
+	if err := syncer.RestoreUnits(services); err != nil {
+		log.WithField("error", err.Error()).Error("failed to restore unit files")
+		return
+	}
+
+	for _, service := range changedServices {
+		if _, ok := runningBefore[service]; !ok {
+			continue
+		}
+		log := log.WithField("service", service).WithField("hash", runningBefore[service])
+		if err := syncer.RestartService(service); err != nil {
+			log.WithField("error", err.Error()).Error("failed to restart service with the previous unit files")
+			continue
+		}
+		log.Info("restarted service with the previous unit files")
+	}
+}
+
+// Creates the services, with at most workers services being created at the same time. Returns the created services,
+// and the errors for the services that couldn't be created.
+func createServices(syncer utils.ServiceSyncer, services map[string]utils.Service, runningServices map[string]string, workers int) (map[string]utils.Service, map[string]error) {
+	names := []string{}
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+
+	created := make(map[string]utils.Service)
+	failed := make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	queue := make(chan string)
+	for i := 0; i < workers && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for service := range queue {
+				log := log.WithField("service", service)
+
+				s, err := syncer.CreateService(service, services[service])
+				if err != nil {
+					log.WithField("error", err.Error()).Error("failed to create service")
+					mu.Lock()
+					failed[service] = err
+					mu.Unlock()
+					continue
+				}
+
+				oldHash := runningServices[service]
+				log = log.WithField("oldHash", oldHash).WithField("newHash", s.Hash)
+				log.Info("service created")
+				if oldHash != s.Hash {
+					log.Info("service changed")
+				}
+
+				mu.Lock()
+				created[service] = s
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, service := range names {
+		queue <- service
+	}
+	close(queue)
+	wg.Wait()
+
+	return created, failed
+}
+
+// Stop orphaned services. Nothing is stopped if it would stop more services than the mass removal limit allows, unless
+// allowMassRemoval is set.
+func orphansDown(syncer utils.ServiceSyncer, allowMassRemoval bool) *SyncError {
+	config, err := syncer.GetConfig()
+	if err != nil {
+		return &SyncError{err: fmt.Errorf("failed to read config: %s", err.Error())}
+	}
 
 	runningServices, err := syncer.GetRunningServices()
 	if err != nil {
@@ -167,8 +358,27 @@ func orphansDown(syncer utils.ServiceSyncer) *SyncError {
 	serviceFailed := []string{}
 
 	orphanedServices := getOrphanedServices(config, runningServices)
+	sort.Strings(orphanedServices)
+
+	for _, service := range getStaleAllowedRemovals(orphanedServices, config.AllowedRemovals) {
+		log.WithField("service", service).Warnf("service in %s isn't stopped by the sync, remove it from the file so it can't be stopped by accident later", filepath.Base(utils.MASS_REMOVAL_MARKER_FILE))
+	}
+
+	if !allowMassRemoval && isMassRemoval(orphanedServices, runningServices, config.AllowedRemovals, config.MassRemovalLimits()) {
+		for _, service := range orphanedServices {
+			log.WithField("service", service).Warn("would stop orphaned service")
+		}
+		err := fmt.Errorf("refusing to stop %d of %d running services, use --allow-mass-removal or list the services in %s to stop them", len(orphanedServices), len(runningServices), filepath.Base(utils.MASS_REMOVAL_MARKER_FILE))
+		return &SyncError{err: err, servicesErrored: orphanedServices}
+	}
 
 	for _, service := range orphanedServices {
+		// The names come from container labels, so they aren't necessarily valid
+		if err := utils.ValidateName("service", service); err != nil {
+			log.WithField("error", err.Error()).Errorf("refusing to stop orphaned service")
+			serviceFailed = append(serviceFailed, service)
+			continue
+		}
 		err := syncer.StopService(service)
 		if err != nil {
 			log.WithField("error", err.Error()).Errorf("failed to stop orphaned service")
@@ -182,6 +392,10 @@ func orphansDown(syncer utils.ServiceSyncer) *SyncError {
 		return &SyncError{err: fmt.Errorf("failed to stop some orphaned services"), servicesErrored: serviceFailed}
 	}
 
+	if err := syncer.Prune(); err != nil {
+		return &SyncError{err: fmt.Errorf("failed to prune unused resources: %s", err.Error())}
+	}
+
 	log.Info("orphaned services cleaned up")
 
 	return nil
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/JonasBak/homelab-gitops/utils"
 )
@@ -14,16 +16,52 @@ type testSyncer struct {
 	createService      func(service string) (string, error)
 	restartService     func(service string) error
 	stopService        func(service string) error
+	runJobs            func(service string) error
+	// Optional, for services that can be reloaded
+	configHash          func(service string) string
+	runningConfigHashes func() map[string]string
+	reloadService       func(service string) error
+	// Optional, called when the sync is rolled back
+	restoreUnits func(services []string) error
 }
 
-func (s *testSyncer) GetConfig() utils.Config {
-	return s.config
+func (s *testSyncer) GetConfig() (utils.Config, error) {
+	return s.config, nil
 }
 func (s *testSyncer) GetRunningServices() (map[string]string, error) {
 	return s.getRunningServices(), nil
 }
-func (s *testSyncer) CreateService(service string, serviceConfig utils.Service) (string, error) {
-	return s.createService(service)
+func (s *testSyncer) CreateService(service string, serviceConfig utils.Service) (utils.Service, error) {
+	hash, err := s.createService(service)
+	serviceConfig.Hash = hash
+	if s.configHash != nil {
+		serviceConfig.ConfigHash = s.configHash(service)
+	}
+	return serviceConfig, err
+}
+func (s *testSyncer) ReloadUnits() error {
+	return nil
+}
+func (s *testSyncer) RestoreUnits(services []string) error {
+	if s.restoreUnits == nil {
+		return nil
+	}
+	return s.restoreUnits(services)
+}
+func (s *testSyncer) GetRunningConfigHashes() (map[string]string, error) {
+	if s.runningConfigHashes == nil {
+		return map[string]string{}, nil
+	}
+	return s.runningConfigHashes(), nil
+}
+func (s *testSyncer) ReloadService(service string, serviceConfig utils.Service) error {
+	return s.reloadService(service)
+}
+func (s *testSyncer) RunJobs(service string) error {
+	if s.runJobs == nil {
+		return nil
+	}
+	return s.runJobs(service)
 }
 func (s *testSyncer) RestartService(service string) error {
 	return s.restartService(service)
@@ -31,6 +69,9 @@ func (s *testSyncer) RestartService(service string) error {
 func (s *testSyncer) StopService(service string) error {
 	return s.stopService(service)
 }
+func (s *testSyncer) Prune() error {
+	return nil
+}
 func (s *testSyncer) RunPre(cmd string) error {
 	return nil
 }
@@ -93,6 +134,29 @@ func TestServicesUp(t *testing.T) {
 	}
 }
 
+func TestServicesUpInvalidServiceName(t *testing.T) {
+	config := utils.Config{
+		Services: map[string]utils.Service{
+			"service-a":   {},
+			"../../other": {},
+		},
+	}
+	syncer := testSyncer{
+		config: config,
+		getRunningServices: func() map[string]string {
+			return map[string]string{}
+		},
+		createService: func(service string) (string, error) {
+			t.Fatalf("service '%s' wasn't expected to be created", service)
+			return "", nil
+		},
+	}
+
+	err := servicesUp(&syncer)
+
+	assert(t, err != nil, "invalid service name should have made servicesUp return error")
+}
+
 func TestServicesUpFailesToStart(t *testing.T) {
 	attempts := map[string]int{
 		"service-a": 0,
@@ -102,6 +166,8 @@ func TestServicesUpFailesToStart(t *testing.T) {
 		"service-e": 0,
 	}
 	runningServices := map[string]string{}
+	stopped := []string{}
+	restored := 0
 	config := utils.Config{
 		Services: map[string]utils.Service{
 			// These are ok
@@ -130,6 +196,16 @@ func TestServicesUpFailesToStart(t *testing.T) {
 			runningServices[service] = service
 			return nil
 		},
+		stopService: func(service string) error {
+			stopped = append(stopped, service)
+			delete(runningServices, service)
+			return nil
+		},
+		restoreUnits: func(services []string) error {
+			assert(t, services == nil, "all the unit files should be restored")
+			restored++
+			return nil
+		},
 	}
 
 	err := servicesUp(&syncer)
@@ -144,17 +220,83 @@ func TestServicesUpFailesToStart(t *testing.T) {
 		}
 	}
 
-	assertEq(t, runningServices["service-a"], "service-a", "service-a should have been started")
-	assertEq(t, runningServices["service-b"], "service-b", "service-b should have been started")
-	assertEq(t, runningServices["service-e"], "service-e", "service-e should have been started")
-	assertEq(t, runningServices["service-c"], "", "service-c should not have been started")
-	assertEq(t, runningServices["service-d"], "", "service-d should not have been started")
+	// The services that started are new, so they are stopped when the sync is rolled back
+	assertEq(t, restored, 1, "unit files should have been restored")
+	assertEq(t, fmt.Sprint(stopped), "[service-a service-b service-e]", "new services should have been stopped")
+	assertEq(t, len(runningServices), 0, "no services should be running")
 
 	sort.Strings(err.servicesErrored)
 	assertEq(t, err.servicesErrored[0], "service-c", "service-c should be reported as failed")
 	assertEq(t, err.servicesErrored[1], "service-d", "service-d should be reported as failed")
 }
 
+func TestServicesUpJobFails(t *testing.T) {
+	runningServices := map[string]string{
+		"service-c": "old",
+	}
+	jobsRun := map[string]int{}
+	restarts := map[string]int{}
+	stopped := []string{}
+	restored := []string{}
+	config := utils.Config{
+		Services: map[string]utils.Service{
+			"service-a": {},
+			// The job of this service fails
+			"service-b": {},
+			// Updated service
+			"service-c": {},
+		},
+	}
+	syncer := testSyncer{
+		config: config,
+		getRunningServices: func() map[string]string {
+			return runningServices
+		},
+		createService: func(service string) (string, error) {
+			return service, nil
+		},
+		runJobs: func(service string) error {
+			jobsRun[service] = jobsRun[service] + 1
+			if service == "service-b" {
+				return fmt.Errorf("job failed")
+			}
+			return nil
+		},
+		restartService: func(service string) error {
+			if service == "service-b" {
+				t.Fatalf("service-b shouldn't be restarted when its job fails")
+			}
+			restarts[service] = restarts[service] + 1
+			runningServices[service] = service
+			return nil
+		},
+		stopService: func(service string) error {
+			stopped = append(stopped, service)
+			delete(runningServices, service)
+			return nil
+		},
+		restoreUnits: func(services []string) error {
+			restored = append(restored, services...)
+			return nil
+		},
+	}
+
+	err := servicesUp(&syncer)
+
+	if err == nil {
+		t.Fatal("failed job should have made servicesUp return error")
+	}
+
+	assertEq(t, jobsRun["service-a"], 1, "jobs of service-a should have run once")
+	assertEq(t, jobsRun["service-b"], 1, "jobs of service-b should have run once")
+	assertEq(t, fmt.Sprint(restored), "[service-b]", "only the unit files of service-b should have been restored")
+	assertEq(t, len(stopped), 0, "the other new service shouldn't have been stopped")
+	assertEq(t, restarts["service-c"], 1, "the updated service shouldn't have been rolled back")
+	assertEq(t, runningServices["service-c"], "service-c", "the updated service should run the new version")
+	assertEq(t, len(err.servicesErrored), 1, "only service-b should be reported as failed")
+	assertEq(t, err.servicesErrored[0], "service-b", "service-b should be reported as failed")
+}
+
 func TestOrphansDown(t *testing.T) {
 	expectToStop := map[string]int{
 		"service-c": 0,
@@ -187,7 +329,7 @@ func TestOrphansDown(t *testing.T) {
 		},
 	}
 
-	orphansDown(&syncer)
+	orphansDown(&syncer, false)
 
 	for service, count := range expectToStop {
 		if count != 1 {
@@ -195,3 +337,166 @@ func TestOrphansDown(t *testing.T) {
 		}
 	}
 }
+
+func TestServicesUpReload(t *testing.T) {
+	runningServices := map[string]string{
+		"service-a": "service-a",
+		"service-b": "service-b",
+		"service-c": "123",
+		"service-d": "service-d",
+	}
+	runningConfigHashes := map[string]string{
+		"service-a": "old",
+		"service-b": "service-b-config",
+		"service-c": "old",
+		"service-d": "",
+	}
+	config := utils.Config{
+		Services: map[string]utils.Service{
+			// Only the config changed
+			"service-a": {},
+			// Nothing changed
+			"service-b": {},
+			// The service changed, restarting it uses the new config
+			"service-c": {},
+			// Can't be reloaded
+			"service-d": {},
+		},
+	}
+	reloaded := []string{}
+	restarted := []string{}
+	syncer := testSyncer{
+		config: config,
+		getRunningServices: func() map[string]string {
+			return runningServices
+		},
+		createService: func(service string) (string, error) {
+			return service, nil
+		},
+		configHash: func(service string) string {
+			if service == "service-d" {
+				return ""
+			}
+			return service + "-config"
+		},
+		runningConfigHashes: func() map[string]string {
+			return runningConfigHashes
+		},
+		reloadService: func(service string) error {
+			runningConfigHashes[service] = service + "-config"
+			reloaded = append(reloaded, service)
+			return nil
+		},
+		restartService: func(service string) error {
+			runningServices[service] = service
+			runningConfigHashes[service] = service + "-config"
+			restarted = append(restarted, service)
+			return nil
+		},
+	}
+
+	if err := servicesUp(&syncer); err != nil {
+		t.Fatalf("servicesUp should have exited without error, but got: %s", err.Error())
+	}
+	assertEq(t, fmt.Sprint(reloaded), "[service-a]", "reloaded services")
+	assertEq(t, fmt.Sprint(restarted), "[service-c]", "restarted services")
+
+	reloaded = []string{}
+	runningConfigHashes["service-a"] = "old"
+	syncer.reloadService = func(service string) error {
+		return fmt.Errorf("reload failed")
+	}
+	err := servicesUp(&syncer)
+	if err == nil {
+		t.Fatalf("servicesUp should fail when a service can't be reloaded")
+	}
+	assertEq(t, fmt.Sprint(err.servicesErrored), "[service-a]", "errored services")
+}
+
+func TestCreateServicesWorkers(t *testing.T) {
+	services := map[string]utils.Service{}
+	for i := 0; i < 10; i++ {
+		services[fmt.Sprintf("service-%d", i)] = utils.Service{}
+	}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	syncer := testSyncer{
+		createService: func(service string) (string, error) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if service == "service-3" || service == "service-7" {
+				return "", fmt.Errorf("%s failed", service)
+			}
+			return service, nil
+		},
+	}
+
+	created, failed := createServices(&syncer, services, map[string]string{}, 3)
+	assertEq(t, maxRunning, 3, "at most 3 services should be created at the same time")
+	assertEq(t, len(created), 8, "created services")
+	assertEq(t, created["service-1"].Hash, "service-1", "created services should have their hash")
+	assertEq(t, len(failed), 2, "failed services")
+
+	restored := 0
+	syncer.config = utils.Config{Services: services, Workers: 3}
+	syncer.getRunningServices = func() map[string]string {
+		return map[string]string{}
+	}
+	syncer.restoreUnits = func(services []string) error {
+		restored++
+		return nil
+	}
+	err := servicesUp(&syncer)
+	if err == nil {
+		t.Fatalf("servicesUp should fail when services can't be created")
+	}
+	assertEq(t, fmt.Sprint(err.servicesErrored), "[service-3 service-7]", "errored services should be sorted")
+	assertEq(t, err.Error(), "failed to create service: service-3 failed", "the error of the first service should be used")
+	assertEq(t, restored, 1, "unit files applied while creating the services should be restored")
+}
+
+func TestOrphansDownMassRemoval(t *testing.T) {
+	runningServices := map[string]string{
+		"service-a": "a",
+		"service-b": "b",
+		"service-c": "c",
+	}
+	stopped := []string{}
+	syncer := testSyncer{
+		config: utils.Config{Services: map[string]utils.Service{}},
+		getRunningServices: func() map[string]string {
+			return runningServices
+		},
+		stopService: func(service string) error {
+			stopped = append(stopped, service)
+			return nil
+		},
+	}
+
+	err := orphansDown(&syncer, false)
+	assert(t, err != nil, "stopping all services should be refused")
+	assertEq(t, len(stopped), 0, "no services should be stopped")
+	assertEq(t, fmt.Sprint(err.servicesErrored), "[service-a service-b service-c]", "the services that would be stopped should be reported")
+
+	syncer.config.AllowedRemovals = []string{"service-a", "service-b"}
+	err = orphansDown(&syncer, false)
+	assert(t, err == nil, "services allowed by the marker should be stopped")
+	assertEq(t, len(stopped), 3, "all services should be stopped")
+
+	stopped = []string{}
+	syncer.config.AllowedRemovals = nil
+	err = orphansDown(&syncer, true)
+	assert(t, err == nil, "mass removal should be allowed by the flag")
+	assertEq(t, len(stopped), 3, "all services should be stopped")
+}
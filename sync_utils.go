@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sort"
+
 	"github.com/JonasBak/homelab-gitops/utils"
 )
 
@@ -27,3 +29,80 @@ func getUpdatedServices(config utils.Config, runningServices map[string]string)
 
 	return updatedServices
 }
+
+// Returns the services that have the same service hash as the running service, but where the files that can be
+// reloaded have changed
+func getReloadedServices(config utils.Config, runningServices map[string]string, runningConfigHashes map[string]string) []string {
+	reloadedServices := []string{}
+
+	for service, s := range config.Services {
+		if s.Hash == "" || s.Hash != runningServices[service] || s.ConfigHash == "" {
+			continue
+		}
+		if s.ConfigHash != runningConfigHashes[service] {
+			reloadedServices = append(reloadedServices, service)
+		}
+	}
+
+	sort.Strings(reloadedServices)
+	return reloadedServices
+}
+
+// Returns the services that were started, stopped or restarted with another hash between the two lists of running
+// services
+func getChangedServices(runningBefore map[string]string, runningAfter map[string]string) []string {
+	changedServices := []string{}
+
+	for service, hash := range runningAfter {
+		if runningBefore[service] != hash {
+			changedServices = append(changedServices, service)
+		}
+	}
+	for service := range runningBefore {
+		if _, ok := runningAfter[service]; !ok {
+			changedServices = append(changedServices, service)
+		}
+	}
+
+	sort.Strings(changedServices)
+	return changedServices
+}
+
+// Returns true if stopping the orphaned services, except the ones that are allowed to be removed, would stop more
+// services than the mass removal limits allow. The percentage of the running services only applies when more than
+// limits.MinServices services are stopped.
+func isMassRemoval(orphanedServices []string, runningServices map[string]string, allowed []string, limits utils.MassRemoval) bool {
+	allowedSet := make(map[string]struct{})
+	for _, service := range allowed {
+		allowedSet[service] = struct{}{}
+	}
+	removed := 0
+	for _, service := range orphanedServices {
+		if _, ok := allowedSet[service]; !ok {
+			removed++
+		}
+	}
+	if removed == 0 {
+		return false
+	}
+	if removed > limits.MaxServices {
+		return true
+	}
+	return removed > limits.MinServices && removed*100 > len(runningServices)*limits.MaxPercent
+}
+
+// Returns the services listed in the mass removal marker that aren't stopped by the sync, the entries never expire so
+// they should be removed from the marker once the services are gone
+func getStaleAllowedRemovals(orphanedServices []string, allowed []string) []string {
+	orphanedSet := make(map[string]struct{})
+	for _, service := range orphanedServices {
+		orphanedSet[service] = struct{}{}
+	}
+	stale := []string{}
+	for _, service := range allowed {
+		if _, ok := orphanedSet[service]; !ok {
+			stale = append(stale, service)
+		}
+	}
+	return stale
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/JonasBak/homelab-gitops/utils"
 	"sort"
 	"testing"
@@ -76,3 +78,61 @@ func TestGetUpdatedServices(t *testing.T) {
 	assertEq(t, updatedServices[0], "service-b", "expected service-b to be updated")
 	assertEq(t, updatedServices[1], "service-d", "expected service-d to be updated")
 }
+
+func TestGetChangedServices(t *testing.T) {
+	runningBefore := map[string]string{
+		// This is unchanged
+		"service-a": "a",
+		// This was restarted with a new hash
+		"service-b": "b",
+		// This was stopped
+		"service-c": "c",
+	}
+	runningAfter := map[string]string{
+		"service-a": "a",
+		"service-b": "2",
+		// This was started
+		"service-d": "d",
+	}
+
+	changedServices := getChangedServices(runningBefore, runningAfter)
+
+	assertEq(t, fmt.Sprint(changedServices), "[service-b service-c service-d]", "expected the started, stopped and restarted services")
+}
+
+func TestIsMassRemoval(t *testing.T) {
+	running := map[string]string{}
+	for i := 0; i < 10; i++ {
+		running[fmt.Sprintf("service-%d", i)] = "a"
+	}
+	limits := utils.Config{}.MassRemovalLimits()
+
+	assert(t, !isMassRemoval([]string{}, running, nil, limits), "stopping nothing isn't a mass removal")
+	assert(t, !isMassRemoval([]string{"service-0", "service-1"}, running, nil, limits), "stopping a few services isn't a mass removal")
+	assert(t, isMassRemoval([]string{"service-0", "service-1", "service-2", "service-3", "service-4", "service-5"}, running, nil, limits), "stopping more than the max services is a mass removal")
+	assert(t, !isMassRemoval([]string{"service-0", "service-1", "service-2", "service-3", "service-4", "service-5"}, running, []string{"service-5"}, limits), "allowed services shouldn't count")
+
+	small := map[string]string{"service-a": "a", "service-b": "a", "service-c": "a"}
+	assert(t, !isMassRemoval([]string{"service-a"}, small, nil, limits), "stopping less than the max percentage isn't a mass removal")
+	assert(t, !isMassRemoval([]string{"service-a", "service-b"}, small, nil, limits), "stopping up to the min services isn't a mass removal")
+	assert(t, !isMassRemoval([]string{"service-a"}, map[string]string{"service-a": "a"}, nil, limits), "stopping the only service isn't a mass removal")
+	medium := map[string]string{"service-a": "a", "service-b": "a", "service-c": "a", "service-d": "a", "service-e": "a"}
+	assert(t, isMassRemoval([]string{"service-a", "service-b", "service-c"}, medium, nil, limits), "stopping more than the max percentage is a mass removal")
+
+	maxServices, maxPercent := 8, 80
+	limits = utils.Config{MassRemoval: utils.MassRemovalConfig{MaxServices: &maxServices, MaxPercent: &maxPercent}}.MassRemovalLimits()
+	assertEq(t, limits.MinServices, utils.DEFAULT_MASS_REMOVAL_MIN_SERVICES, "unset limits should use the defaults")
+	assert(t, !isMassRemoval([]string{"service-0", "service-1", "service-2", "service-3", "service-4", "service-5"}, running, nil, limits), "stopping less than the configured limits isn't a mass removal")
+	assert(t, isMassRemoval([]string{"service-0", "service-1", "service-2", "service-3", "service-4", "service-5", "service-6", "service-7", "service-8"}, running, nil, limits), "stopping more than the configured max services is a mass removal")
+
+	maxServices = 0
+	limits = utils.Config{MassRemoval: utils.MassRemovalConfig{MaxServices: &maxServices}}.MassRemovalLimits()
+	assertEq(t, limits.MaxServices, 0, "0 should be a valid limit")
+	assert(t, isMassRemoval([]string{"service-0"}, running, nil, limits), "with max services 0 every removal is a mass removal")
+	assert(t, !isMassRemoval([]string{"service-0"}, running, []string{"service-0"}, limits), "allowed services should still be stopped with max services 0")
+}
+
+func TestGetStaleAllowedRemovals(t *testing.T) {
+	stale := getStaleAllowedRemovals([]string{"service-a"}, []string{"service-a", "service-b"})
+	assertEq(t, fmt.Sprint(stale), "[service-b]", "allowed services that aren't stopped should be stale")
+}
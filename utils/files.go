@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Makes dir contain exactly the files, relative path -> content. Existing files are overwritten in place, so they stay
+// valid for running containers that have them mounted, and files that aren't in files are removed. The directory is
+// removed if there are no files.
+func SyncDir(dir string, files map[string][]byte, perm os.FileMode) error {
+	if len(files) == 0 {
+		return os.RemoveAll(dir)
+	}
+
+	written := make(map[string]struct{})
+	for rel, content := range files {
+		target := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, content, perm); err != nil {
+			return err
+		}
+		// WriteFile doesn't change the mode of existing files
+		if err := os.Chmod(target, perm); err != nil {
+			return err
+		}
+		written[target] = struct{}{}
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if _, ok := written[path]; !ok && !info.IsDir() {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
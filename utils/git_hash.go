@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Service dirs are hashed by the content of the files
+var HASHING_CONTENT = "content"
+
+// Service dirs are hashed by their git tree IDs, so the files don't need to be read
+var HASHING_GIT = "git"
+
+// Returns the git tree ID of the directory at HEAD. If files are excluded from the hash, by .gitopsignore or the
+// options (like the content walk in HashDir), the hash is computed from the entries of `git ls-tree -r` that aren't
+// excluded instead. The directory must
+// not have changes that aren't committed, or files ignored by git that aren't in .gitopsignore, since they wouldn't be
+// part of the hash. Sops files are hashed by their encrypted content, and options.SopsSalt isn't used, see SopsHashes.
+func gitTreeHash(dir string, options HashOptions) (string, error) {
+	logger := options.Log
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+	status, err := RunCommandLog(logger, dir, os.Environ(), "git", "status", "--porcelain", "--untracked-files=all", "--", ".")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(status) != "" {
+		return "", fmt.Errorf("'%s' has changes that aren't committed, which can't be hashed with git", dir)
+	}
+
+	ignore, err := readIgnoreFile(dir)
+	if err != nil {
+		return "", err
+	}
+	// Files ignored by git, like local env files, can still be used by the service
+	ignored, err := RunCommandLog(logger, dir, os.Environ(), "git", "ls-files", "--others", "--ignored", "--exclude-standard", "-z", "--", ".")
+	if err != nil {
+		return "", err
+	}
+	for _, rel := range strings.Split(ignored, "\x00") {
+		if rel != "" && !ignore.matchPath(filepath.ToSlash(rel), false) {
+			return "", fmt.Errorf("'%s' in '%s' is ignored by git, which can't be hashed with git, add it to %s if it isn't used", rel, dir, HASH_IGNORE_FILE)
+		}
+	}
+	if options.NoIgnoreFile {
+		ignore = ignorePatterns{}
+	}
+	ignore = append(ignore, options.Ignore...)
+
+	treeID := func() (string, error) {
+		tree, err := RunCommandLog(logger, dir, os.Environ(), "git", "rev-parse", "HEAD:./")
+		return strings.TrimSpace(tree), err
+	}
+	if len(ignore) == 0 && options.Only == nil && options.Exclude == nil {
+		return treeID()
+	}
+
+	output, err := RunCommandLog(logger, dir, os.Environ(), "git", "ls-tree", "-r", "-z", "HEAD", ".")
+	if err != nil {
+		return "", err
+	}
+	only := ignorePatterns(options.Only)
+
+	sha := sha256.New()
+	excluded := false
+	for _, entry := range strings.Split(output, "\x00") {
+		if entry == "" {
+			continue
+		}
+		// <mode> SP <type> SP <object> TAB <path>
+		info, rel, ok := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 {
+			return "", fmt.Errorf("unexpected git ls-tree output: '%s'", entry)
+		}
+		rel = filepath.ToSlash(rel)
+
+		if ignore.matchPath(rel, false) || (options.Exclude != nil && options.Exclude(filepath.Base(rel))) {
+			excluded = true
+			continue
+		}
+		if options.Only != nil && !only.matchPath(rel, false) {
+			continue
+		}
+		writeRecord(sha, []byte(fields[0]), []byte(fields[1]), []byte(fields[2]), []byte(rel))
+	}
+	// Nothing matched the patterns, so the whole tree is hashed
+	if !excluded && options.Only == nil {
+		return treeID()
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
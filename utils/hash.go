@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// In the dir that is hashed, patterns for files that aren't part of the hash
+var HASH_IGNORE_FILE = ".gitopsignore"
+
+type HashOptions struct {
+	// Files where this returns true, for the name of the file, aren't part of the hash
+	Exclude func(name string) bool
+	// If set, sops files are hashed by their decrypted content with this salt instead of by the encrypted content
+	SopsSalt []byte
+	// Patterns like in .gitopsignore for files that aren't part of the hash, in addition to the ones in the ignore file
+	Ignore []string
+	// If set, only files matching these patterns, or inside directories matching them, are part of the hash
+	Only []string
+	// Hash the directory by its git tree ID instead of by the content of the files, see gitTreeHash
+	Git bool
+	// Don't use the patterns in .gitopsignore, for hashes of files that are used even if they are ignored, like a build
+	// context
+	NoIgnoreFile bool
+	// Logger for the git commands, so they are logged with the service they hash. The standard logger is used if nil.
+	Log *log.Entry
+}
+
+// Patterns from the ignore file. Patterns without a slash match the name of files and directories at any depth, other
+// patterns match the path relative to the hashed dir. A trailing slash only matches directories.
+type ignorePatterns []string
+
+func readIgnoreFile(dir string) (ignorePatterns, error) {
+	content, err := os.ReadFile(filepath.Join(dir, HASH_IGNORE_FILE))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := ignorePatterns{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			return nil, fmt.Errorf("%s: negated patterns aren't supported: '%s'", HASH_IGNORE_FILE, line)
+		}
+		if _, err := filepath.Match(line, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern '%s': %s", HASH_IGNORE_FILE, line, err.Error())
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, nil
+}
+
+func (patterns ignorePatterns) match(rel string, isDir bool) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if !isDir {
+				continue
+			}
+			pattern = strings.TrimSuffix(pattern, "/")
+		}
+		var matched bool
+		if strings.Contains(pattern, "/") {
+			matched, _ = filepath.Match(strings.TrimPrefix(pattern, "/"), rel)
+		} else {
+			matched, _ = filepath.Match(pattern, filepath.Base(rel))
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the path, or one of the directories it is in, matches one of the patterns
+func (patterns ignorePatterns) matchPath(rel string, isDir bool) bool {
+	if patterns.match(rel, isDir) {
+		return true
+	}
+	for dir := filepath.Dir(rel); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if patterns.match(dir, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the fields of a record with the length of each field first, so the boundaries between fields and records
+// can't be confused
+func writeRecord(sha hash.Hash, fields ...[]byte) {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(fields)))
+	_, _ = sha.Write(length)
+	for _, field := range fields {
+		binary.BigEndian.PutUint64(length, uint64(len(field)))
+		_, _ = sha.Write(length)
+		_, _ = sha.Write(field)
+	}
+}
+
+// Hashes the content of a directory, including nested directories. The hash includes the paths relative to the
+// directory, the modes of the files and the targets of symlinks (which aren't followed), so it doesn't change if the
+// directory is moved. Files matching the patterns in .gitopsignore, or where options.Exclude returns true, aren't
+// part of the hash. With options.SopsSalt, re-encrypting sops files without changing the secrets doesn't change it.
+func HashDir(dir string, options HashOptions) (string, error) {
+	if options.Git {
+		return gitTreeHash(dir, options)
+	}
+
+	sha := sha256.New()
+	err := walkHashedFiles(dir, options, func(path string, rel string, info os.FileInfo) error {
+		return writeEntry(sha, path, rel, info, options)
+	})
+	return hex.EncodeToString(sha.Sum(nil)), err
+}
+
+// Returns the salted hashes of the decrypted content of the sops files in the directory that are part of the hash with
+// the options, as `sops:<path>=<hash>`. Used with git hashing, where the tree ID only covers the encrypted content.
+func SopsHashes(dir string, options HashOptions) ([]string, error) {
+	hashes := []string{}
+	err := walkHashedFiles(dir, options, func(path string, rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() || !isEncryptedFile(info.Name()) {
+			return nil
+		}
+		content, err := sopsContentHash(path, options.SopsSalt)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, fmt.Sprintf("sops:%s=%s", rel, hex.EncodeToString(content)))
+		return nil
+	})
+	return hashes, err
+}
+
+// Calls fn for the files, directories and symlinks in the directory that are part of the hash with the options, in
+// lexical order
+func walkHashedFiles(dir string, options HashOptions, fn func(path string, rel string, info os.FileInfo) error) error {
+	ignore := ignorePatterns{}
+	if !options.NoIgnoreFile {
+		patterns, err := readIgnoreFile(dir)
+		if err != nil {
+			return err
+		}
+		ignore = append(ignore, patterns...)
+	}
+	ignore = append(ignore, options.Ignore...)
+	only := ignorePatterns(options.Only)
+
+	return filepath.Walk(dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			rel = filepath.ToSlash(rel)
+
+			if ignore.match(rel, info.IsDir()) || (options.Exclude != nil && !info.IsDir() && options.Exclude(info.Name())) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if options.Only != nil && !only.matchPath(rel, info.IsDir()) {
+				return nil
+			}
+
+			return fn(path, rel, info)
+		})
+}
+
+// Returns the mode of the file like git tracks it, only the executable bit is used, so checkouts with different umasks
+// have the same hash
+func gitFileMode(info os.FileInfo) []byte {
+	if info.Mode().Perm()&0100 != 0 {
+		return []byte("755")
+	}
+	return []byte("644")
+}
+
+// Writes the record for a file, directory or symlink to the hash
+func writeEntry(sha hash.Hash, path string, rel string, info os.FileInfo, options HashOptions) error {
+	mode := gitFileMode(info)
+
+	switch {
+	case info.IsDir():
+		writeRecord(sha, []byte("dir"), []byte(rel))
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		writeRecord(sha, []byte("symlink"), []byte(rel), []byte(target))
+	case info.Mode().IsRegular() && options.SopsSalt != nil && isEncryptedFile(info.Name()):
+		content, err := sopsContentHash(path, options.SopsSalt)
+		if err != nil {
+			return err
+		}
+		writeRecord(sha, []byte("sops"), []byte(rel), mode, content)
+	case info.Mode().IsRegular():
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		content := sha256.New()
+		if _, err := io.Copy(content, file); err != nil {
+			return err
+		}
+		writeRecord(sha, []byte("file"), []byte(rel), mode, content.Sum(nil))
+	default:
+		return fmt.Errorf("unsupported file type for '%s'", rel)
+	}
+	return nil
+}
+
+// Hashes a file or a directory, files are hashed the same way as in HashDir
+func HashPath(path string, options HashOptions) (string, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return HashDir(path, options)
+	}
+	sha := sha256.New()
+	if err := writeEntry(sha, path, filepath.Base(path), info, options); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sha.Sum(nil)), nil
+}
@@ -8,20 +8,34 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 
-	"github.com/getsops/sops/v3/decrypt"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
 )
 
 type ServiceSyncer interface {
-	GetConfig() Config
+	GetConfig() (Config, error)
 	GetRunningServices() (map[string]string, error)
-	CreateService(service string, serviceConfig Service) (string, error)
+	// Returns the service with Hash and ConfigHash set
+	CreateService(service string, serviceConfig Service) (Service, error)
+	// Makes the unit files written when creating the services available, called once after all services are created
+	ReloadUnits() error
+	// Restores the unit files of the services from before the sync, or all the unit files changed during the sync if
+	// services is nil, when the sync fails after unit files have been applied
+	RestoreUnits(services []string) error
+	// Runs the jobs of the service that haven't completed for their current version, before the service is restarted
+	RunJobs(service string) error
 	RestartService(service string) error
+	// Returns a map of running service name -> hash of the files that can be reloaded
+	GetRunningConfigHashes() (map[string]string, error)
+	// Reloads the files of a running service, the service hash must be the same as for the running service
+	ReloadService(service string, serviceConfig Service) error
 	StopService(service string) error
+	// Remove resources, like secrets, that are no longer used by any service
+	Prune() error
 
 	RunPre(cmd string) error
 	RunPost(cmd string) error
@@ -30,16 +44,65 @@ type ServiceSyncer interface {
 // Relative to hostGitopsDir
 var CONFIG_FILE_PATH = "%s/config.yml"
 
+// Relative to hostGitopsDir, lists the services that can be stopped even if the sync stops more services than the
+// mass removal limit allows
+var MASS_REMOVAL_MARKER_FILE = "%s/.allow-mass-removal"
+
 // Relative to service dir
 var SERVICE_MANIFEST_FILE = "%s/manifest.yml"
 
 // Relative to service dir
 var SERVICE_MANIFEST_SOPS_FILE = "%s/manifest.sops.yml"
 
+// Relative to service dir, a hand written unit file used instead of the manifest
+var SERVICE_QUADLET_FILE = "%s/service.container"
+
+// Relative to service dir or rendered dir, kubernetes yaml for services that should run with `podman kube play`
+var SERVICE_KUBE_FILE = "%s/kube.yml"
+
+// Relative to service dir, the image of the service is built from this file if it exists
+var SERVICE_CONTAINERFILE = "%s/Containerfile"
+
 type Manifest struct {
 	Container map[string][]string `yaml:"Container"`
 	Unit      map[string][]string `yaml:"Unit"`
 	Service   map[string][]string `yaml:"Service"`
+
+	// If Pod or Containers is set, the service is a pod with the containers in Containers, and Unit and Service are used
+	// for the pod
+	Pod        map[string][]string     `yaml:"Pod"`
+	Containers map[string]PodContainer `yaml:"Containers"`
+
+	// Used for services with a kube yaml, Unit and Service are used for the kube unit
+	Kube map[string][]string `yaml:"Kube"`
+
+	// Containers that run to completion once for each version of the job, before the service is restarted
+	Jobs map[string]PodContainer `yaml:"jobs"`
+
+	// Containers that run to completion, in the order of their names, every time before the service starts
+	Init map[string]PodContainer `yaml:"init"`
+
+	// Files that can be reloaded without restarting the service, and how to reload them
+	Reload Reload `yaml:"reload"`
+
+	// Only read from the sops manifest, secret name -> value
+	Secrets map[string]string `yaml:"-"`
+}
+
+// A container in a pod, or a job
+type PodContainer struct {
+	Container map[string][]string `yaml:"Container"`
+	Unit      map[string][]string `yaml:"Unit"`
+	Service   map[string][]string `yaml:"Service"`
+}
+
+// The content of the sops manifest
+type SopsManifest struct {
+	// Section name -> section, merged into the manifest
+	Sections map[string]map[string][]string
+	// Container name -> section name -> section, merged into the containers of the manifest
+	Containers map[string]map[string]map[string][]string
+	Secrets    map[string]string
 }
 
 type PrePostScript struct {
@@ -48,29 +111,167 @@ type PrePostScript struct {
 
 type Service struct {
 	Hash string
+	// Hash of the files that can be reloaded, empty if the service can't be reloaded
+	ConfigHash string `yaml:"-"`
+	// How the service reloads the files, from the manifest
+	Reload Reload `yaml:"-"`
+
+	// Available in the manifest and templates, merged with the vars for the host
+	Vars map[string]string `yaml:"vars"`
+
+	// Either SERVICE_KIND_SERVICE (the default) or SERVICE_KIND_JOB
+	Kind string `yaml:"kind"`
+	// When jobs run, in the OnCalendar format of systemd timers
+	Schedule string `yaml:"schedule"`
+
+	// What to do when a new image is pulled for a tag used by the service, IMAGE_UPDATES_RESTART (the default),
+	// IMAGE_UPDATES_NOTIFY or IMAGE_UPDATES_IGNORE
+	ImageUpdates string `yaml:"imageUpdates"`
+}
+
+// The digests of the images are part of the service hash, so the service is restarted when they change
+var IMAGE_UPDATES_RESTART = "restart"
+
+// New images are logged, but the service isn't restarted
+var IMAGE_UPDATES_NOTIFY = "notify"
+
+var IMAGE_UPDATES_IGNORE = "ignore"
+
+func (service Service) ImageUpdatesMode() string {
+	if service.ImageUpdates == "" {
+		return IMAGE_UPDATES_RESTART
+	}
+	return service.ImageUpdates
+}
+
+// Services that should be running all the time
+var SERVICE_KIND_SERVICE = "service"
+
+// Services that run to completion on a schedule
+var SERVICE_KIND_JOB = "job"
+
+func (service Service) IsJob() bool {
+	return service.Kind == SERVICE_KIND_JOB
 }
 
+// Relative to hostGitopsDir
+var HOST_SECRETS_SOPS_FILE = "%s/secrets.sops.yml"
+
+// Key in the sops manifest and the host secrets file with secrets that should be created as podman secrets
+var SOPS_SECRETS_KEY = "secrets"
+
 type Config struct {
 	Pre  *PrePostScript `yaml:"pre"`
 	Post *PrePostScript `yaml:"post"`
 
 	Networks map[string]map[string][]string `yaml:"networks"`
 	Volumes  map[string]map[string][]string `yaml:"volumes"`
+	Images   map[string]map[string][]string `yaml:"images"`
 	Services map[string]Service             `yaml:"services"`
+
+	// Available in the manifest and templates for all services
+	Vars map[string]string `yaml:"vars"`
+
+	// How many services are prepared at the same time, DEFAULT_WORKERS if it isn't set
+	Workers int `yaml:"workers"`
+
+	// How the service dirs are hashed, HASHING_CONTENT (the default) or HASHING_GIT
+	Hashing string `yaml:"hashing"`
+
+	// How many orphaned services a sync can stop, see MassRemovalLimits
+	MassRemoval MassRemovalConfig `yaml:"massRemoval"`
+
+	// Services from MASS_REMOVAL_MARKER_FILE that can be stopped regardless of the mass removal limit
+	AllowedRemovals []string `yaml:"-"`
+}
+
+var DEFAULT_WORKERS = 4
+
+// Limits for stopping orphaned services, so an emptied config.yml doesn't stop everything on the host
+type MassRemoval struct {
+	// A sync can't stop more than this many services
+	MaxServices int `yaml:"maxServices"`
+	// A sync can't stop more than this percentage of the running services
+	MaxPercent int `yaml:"maxPercent"`
+	// The percentage only applies when more than this many services are stopped, so hosts with few services can still
+	// remove one or two of them
+	MinServices int `yaml:"minServices"`
+}
+
+// The mass removal limits in config.yml, nil for the values that aren't set so they use the defaults. 0 is a valid
+// limit, like maxServices: 0 to require approval for every removal.
+type MassRemovalConfig struct {
+	MaxServices *int `yaml:"maxServices"`
+	MaxPercent  *int `yaml:"maxPercent"`
+	MinServices *int `yaml:"minServices"`
+}
+
+var DEFAULT_MASS_REMOVAL_MAX_SERVICES = 5
+var DEFAULT_MASS_REMOVAL_MAX_PERCENT = 50
+var DEFAULT_MASS_REMOVAL_MIN_SERVICES = 2
+
+// Returns the mass removal limits, with the defaults for the values that aren't set
+func (config Config) MassRemovalLimits() MassRemoval {
+	limits := MassRemoval{
+		MaxServices: DEFAULT_MASS_REMOVAL_MAX_SERVICES,
+		MaxPercent:  DEFAULT_MASS_REMOVAL_MAX_PERCENT,
+		MinServices: DEFAULT_MASS_REMOVAL_MIN_SERVICES,
+	}
+	if config.MassRemoval.MaxServices != nil {
+		limits.MaxServices = *config.MassRemoval.MaxServices
+	}
+	if config.MassRemoval.MaxPercent != nil {
+		limits.MaxPercent = *config.MassRemoval.MaxPercent
+	}
+	if config.MassRemoval.MinServices != nil {
+		limits.MinServices = *config.MassRemoval.MinServices
+	}
+	return limits
+}
+
+// Returns how many services can be prepared at the same time
+func (config Config) WorkerCount() int {
+	if config.Workers == 0 {
+		return DEFAULT_WORKERS
+	}
+	return config.Workers
 }
 
-func ReadConfigFile(path string) Config {
+// Reads the config of the host, yaml errors are returned as ValidationErrors with the location in the file
+func ReadConfigFile(path string) (Config, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatalf("read yaml failed: %v", err)
+		return Config{}, err
 	}
 
 	config := Config{}
 	if err := yaml.Unmarshal(b, &config); err != nil {
-		log.Fatalf("unmarshal yaml failed: %v", err)
+		return Config{}, ValidationErrors(yamlErrors(path, err))
+	}
+
+	for name, service := range config.Services {
+		vars := make(map[string]string)
+		for k, v := range config.Vars {
+			vars[k] = v
+		}
+		for k, v := range service.Vars {
+			vars[k] = v
+		}
+		service.Vars = vars
+		config.Services[name] = service
+	}
+
+	allowed, err := ReadFile(fmt.Sprintf(MASS_REMOVAL_MARKER_FILE, filepath.Dir(path)))
+	if err != nil && !os.IsNotExist(err) {
+		return Config{}, err
+	}
+	for _, line := range strings.Split(allowed, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			config.AllowedRemovals = append(config.AllowedRemovals, line)
+		}
 	}
 
-	return config
+	return config, nil
 }
 
 func ReadFile(filename string) (string, error) {
@@ -82,7 +283,21 @@ func ReadFile(filename string) (string, error) {
 }
 
 func RunCommand(pwd string, env []string, panicOnErr bool, cmdRaw string, args ...string) (string, error) {
-	log.WithFields(log.Fields{
+	return runCommand(log.NewEntry(log.StandardLogger()), pwd, env, panicOnErr, nil, cmdRaw, args...)
+}
+
+// Same as RunCommand, but logs with the fields of the logger, like the service the command runs for
+func RunCommandLog(logger *log.Entry, pwd string, env []string, cmdRaw string, args ...string) (string, error) {
+	return runCommand(logger, pwd, env, false, nil, cmdRaw, args...)
+}
+
+// Same as RunCommandLog, but with input written to stdin. The input is never logged.
+func RunCommandWithInput(logger *log.Entry, pwd string, env []string, input []byte, cmdRaw string, args ...string) (string, error) {
+	return runCommand(logger, pwd, env, false, input, cmdRaw, args...)
+}
+
+func runCommand(logger *log.Entry, pwd string, env []string, panicOnErr bool, input []byte, cmdRaw string, args ...string) (string, error) {
+	logger.WithFields(log.Fields{
 		"pwd":  pwd,
 		"cmd":  cmdRaw,
 		"args": args,
@@ -92,20 +307,23 @@ func RunCommand(pwd string, env []string, panicOnErr bool, cmdRaw string, args .
 	if pwd != "" {
 		cmd.Dir = pwd
 	}
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 	err := cmd.Run()
 	if err != nil {
-		log.WithFields(log.Fields{
+		logger.WithFields(log.Fields{
 			"stdout": stdout.String(),
 			"stderr": stderr.String(),
 			"cmd":    cmdRaw,
 			"args":   args,
 		}).Warn(stderr.String())
 		if panicOnErr {
-			log.Fatal(err)
+			logger.Fatal(err)
 		} else {
 			return "", err
 		}
@@ -118,7 +336,53 @@ func PathExists(path string) bool {
 	return err == nil
 }
 
-func BuildFields(kvs map[string][]string, templateKV map[string]string) string {
+var templateVariable = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+var unitKey = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// Checks that the value can be written as the value of a key in a unit file. Values can't contain newlines or other
+// control characters, since they would end the value, and can't end with a backslash, since that would continue the
+// value on the next line.
+func CheckUnitValue(value string) error {
+	for _, c := range value {
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return fmt.Errorf("value contains a control character")
+		}
+	}
+	if strings.HasSuffix(value, "\\") {
+		return fmt.Errorf("value ends with a backslash, which would continue the line")
+	}
+	return nil
+}
+
+// Escapes % so the value isn't interpreted as systemd specifiers, and checks that the value can be written to a unit
+// file
+func EscapeUnitValue(value string) (string, error) {
+	if err := CheckUnitValue(value); err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(value, "%", "%%"), nil
+}
+
+// Replaces `${KEY}` with the value of KEY in templateKV, variables that aren't in templateKV are left as they are. The
+// values are escaped with EscapeUnitValue, so they can't add new lines or specifiers to the unit file.
+func ReplaceTemplateValues(value string, templateKV map[string]string) (string, error) {
+	var err error
+	replaced := templateVariable.ReplaceAllStringFunc(value, func(match string) string {
+		v, ok := templateKV[templateVariable.FindStringSubmatch(match)[1]]
+		if !ok {
+			return match
+		}
+		escaped, escapeErr := EscapeUnitValue(v)
+		if escapeErr != nil && err == nil {
+			err = fmt.Errorf("variable %s: %s", match, escapeErr.Error())
+		}
+		return escaped
+	})
+	return replaced, err
+}
+
+func BuildFields(kvs map[string][]string, templateKV map[string]string) (string, error) {
 	fields := ""
 
 	keys := make([]string, 0, len(kvs))
@@ -129,91 +393,271 @@ func BuildFields(kvs map[string][]string, templateKV map[string]string) string {
 	sort.Strings(keys)
 
 	for _, field := range keys {
+		if !unitKey.MatchString(field) {
+			return "", fmt.Errorf("invalid key %q", field)
+		}
 		values := kvs[field]
 		for i := range values {
-			value := values[i]
-			for k, v := range templateKV {
-				value = strings.ReplaceAll(value, fmt.Sprintf("${%s}", k), v)
+			value, err := ReplaceTemplateValues(values[i], templateKV)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", field, err.Error())
+			}
+			if err := CheckUnitValue(value); err != nil {
+				return "", fmt.Errorf("%s: %s", field, err.Error())
 			}
 			fields += fmt.Sprintf("%s=%s\n", field, value)
 		}
 	}
-	return fields
+	return fields, nil
 }
 
-func ReadManifest(serviceDir string) (Manifest, error) {
-	config := Manifest{
-		make(map[string][]string),
-		make(map[string][]string),
-		make(map[string][]string),
+// Suffix for keys in the sops manifest that should replace the values of the key in the manifest, instead of being
+// appended to them. Replacing a key with an empty list (or null) removes the key.
+var SOPS_REPLACE_SUFFIX = "!"
+
+func newManifest() Manifest {
+	return Manifest{
+		Container:  make(map[string][]string),
+		Unit:       make(map[string][]string),
+		Service:    make(map[string][]string),
+		Pod:        make(map[string][]string),
+		Containers: make(map[string]PodContainer),
+		Kube:       make(map[string][]string),
+		Jobs:       make(map[string]PodContainer),
+		Init:       make(map[string]PodContainer),
 	}
+}
 
-	manifest, err := os.ReadFile(fmt.Sprintf(SERVICE_MANIFEST_FILE, serviceDir))
-	if err != nil {
-		return config, err
+func (m Manifest) IsPod() bool {
+	return len(m.Pod) > 0 || len(m.Containers) > 0
+}
+
+// Returns the Container sections of the manifest, for a pod this is the Container section of each container. The
+// Container sections of the init containers and the jobs are included after the containers of the service.
+func (m Manifest) ContainerSections() []map[string][]string {
+	sections := []map[string][]string{}
+	if !m.IsPod() {
+		sections = append(sections, m.Container)
+	} else {
+		for _, name := range SortedKeys(m.Containers) {
+			sections = append(sections, m.Containers[name].Container)
+		}
+	}
+	for _, name := range SortedKeys(m.Init) {
+		sections = append(sections, m.Init[name].Container)
+	}
+	for _, name := range SortedKeys(m.Jobs) {
+		sections = append(sections, m.Jobs[name].Container)
+	}
+	return sections
+}
+
+// Returns the names of the containers, sorted
+func SortedKeys(containers map[string]PodContainer) []string {
+	names := make([]string, 0, len(containers))
+	for name := range containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func ensureSection(section *map[string][]string) map[string][]string {
+	if *section == nil {
+		*section = make(map[string][]string)
+	}
+	return *section
+}
+
+// Returns the sections of the manifest by the name used in the yaml files, the maps are shared with the manifest
+func (m *Manifest) sections() map[string]map[string][]string {
+	return map[string]map[string][]string{
+		"Container": ensureSection(&m.Container),
+		"Unit":      ensureSection(&m.Unit),
+		"Service":   ensureSection(&m.Service),
+		"Pod":       ensureSection(&m.Pod),
+		"Kube":      ensureSection(&m.Kube),
+	}
+}
+
+// Returns the sections of the container by the name used in the yaml files, the maps are shared with the container
+func (c *PodContainer) sections() map[string]map[string][]string {
+	return map[string]map[string][]string{
+		"Container": ensureSection(&c.Container),
+		"Unit":      ensureSection(&c.Unit),
+		"Service":   ensureSection(&c.Service),
+	}
+}
+
+// Merges the sops sections into the sections. Values are appended to existing keys, unless the key has the
+// SOPS_REPLACE_SUFFIX.
+func mergeSections(sections map[string]map[string][]string, sopsSections map[string]map[string][]string) error {
+	for sectionName, sopsSection := range sopsSections {
+		section, ok := sections[sectionName]
+		if !ok {
+			return fmt.Errorf("unknown section '%s' in sops manifest", sectionName)
+		}
+		for k, v := range sopsSection {
+			if strings.HasSuffix(k, SOPS_REPLACE_SUFFIX) {
+				k = strings.TrimSuffix(k, SOPS_REPLACE_SUFFIX)
+				if len(v) == 0 {
+					delete(section, k)
+				} else {
+					section[k] = v
+				}
+				continue
+			}
+			section[k] = append(section[k], v...)
+		}
+	}
+
+	return nil
+}
+
+// Merges the decrypted sops manifest into the manifest
+func mergeSopsManifest(manifest *Manifest, sopsManifest SopsManifest) error {
+	if err := mergeSections(manifest.sections(), sopsManifest.Sections); err != nil {
+		return err
+	}
+
+	for name, sopsSections := range sopsManifest.Containers {
+		container, ok := manifest.Containers[name]
+		if !ok {
+			return fmt.Errorf("unknown container '%s' in sops manifest", name)
+		}
+		if err := mergeSections(container.sections(), sopsSections); err != nil {
+			return fmt.Errorf("container '%s': %s", name, err.Error())
+		}
+		manifest.Containers[name] = container
+	}
+
+	manifest.Secrets = sopsManifest.Secrets
+
+	return nil
+}
+
+// Key in the sops manifest with sections for the containers of a pod
+var SOPS_CONTAINERS_KEY = "Containers"
+
+// Key in the manifest with the jobs of the service
+var MANIFEST_JOBS_KEY = "jobs"
+
+// Key in the manifest with the init containers of the service
+var MANIFEST_INIT_KEY = "init"
+
+// Reads the sops manifest, if it exists
+func ReadSopsManifest(serviceDir string) (SopsManifest, error) {
+	sopsManifest := SopsManifest{
+		Sections:   make(map[string]map[string][]string),
+		Containers: make(map[string]map[string]map[string][]string),
 	}
-	var manifestSops *[]byte = nil
+
 	sopsFile := fmt.Sprintf(SERVICE_MANIFEST_SOPS_FILE, serviceDir)
-	if PathExists(sopsFile) {
-		s, err := decrypt.File(sopsFile, "yaml")
+	if !PathExists(sopsFile) {
+		return sopsManifest, nil
+	}
+	manifestSops, err := decryptFile(sopsFile, "yaml")
+	if err != nil {
+		return sopsManifest, err
+	}
+
+	sopsNodes := make(map[string]yaml.Node)
+	if err := yaml.Unmarshal(manifestSops, &sopsNodes); err != nil {
+		return sopsManifest, err
+	}
+	for k, node := range sopsNodes {
+		switch k {
+		case SOPS_SECRETS_KEY:
+			err = node.Decode(&sopsManifest.Secrets)
+		case SOPS_CONTAINERS_KEY:
+			err = node.Decode(&sopsManifest.Containers)
+		default:
+			section := make(map[string][]string)
+			err = node.Decode(&section)
+			sopsManifest.Sections[k] = section
+		}
 		if err != nil {
-			return config, err
+			return sopsManifest, err
 		}
-		manifestSops = &s
+	}
+
+	return sopsManifest, nil
+}
+
+func ReadManifest(serviceDir string) (Manifest, error) {
+	config := newManifest()
+
+	manifest, err := os.ReadFile(fmt.Sprintf(SERVICE_MANIFEST_FILE, serviceDir))
+	if err != nil {
+		return config, err
+	}
+	sopsManifest, err := ReadSopsManifest(serviceDir)
+	if err != nil {
+		return config, err
 	}
 
 	if err := yaml.Unmarshal(manifest, &config); err != nil {
 		return config, err
 	}
-	if manifestSops != nil {
-		sopsConfig := Manifest{
-			make(map[string][]string),
-			make(map[string][]string),
-			make(map[string][]string),
+	if err := mergeSopsManifest(&config, sopsManifest); err != nil {
+		return config, err
+	}
+
+	if config.IsPod() && len(config.Container) > 0 {
+		return config, fmt.Errorf("the Container section can't be used for pods, use Containers instead")
+	}
+	for name := range config.Containers {
+		if err := ValidateName("container", name); err != nil {
+			return config, err
 		}
-		if err := yaml.Unmarshal(*manifestSops, &sopsConfig); err != nil {
+	}
+	for name := range config.Jobs {
+		if err := ValidateName("job", name); err != nil {
 			return config, err
 		}
-		for k, v := range sopsConfig.Container {
-			if values, ok := config.Container[k]; ok {
-				config.Container[k] = append(values, v...)
-			} else {
-				config.Container[k] = v
-			}
+	}
+	for name := range config.Init {
+		if err := ValidateName("init container", name); err != nil {
+			return config, err
 		}
 	}
+	if err := config.Reload.validate(config); err != nil {
+		return config, err
+	}
 
 	return config, nil
 }
 
-// This hashes the content of a directory. It doesn't currently support traversing nested directories.
-func HashDir(dir string) (string, error) {
-	sha := sha256.New()
+// Reads the secrets in the host secrets file, if it exists
+func ReadHostSecrets(hostGitopsDir string) (map[string]string, error) {
+	secrets := struct {
+		Secrets map[string]string `yaml:"secrets"`
+	}{}
 
-	err := filepath.Walk(dir,
-		func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-
-			if info.IsDir() {
-				_, err = sha.Write([]byte(path))
-				return err
-			}
-
-			_, err = sha.Write([]byte(path))
-			if err != nil {
-				return err
-			}
+	sopsFile := fmt.Sprintf(HOST_SECRETS_SOPS_FILE, hostGitopsDir)
+	if !PathExists(sopsFile) {
+		return secrets.Secrets, nil
+	}
+	s, err := decryptFile(sopsFile, "yaml")
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(s, &secrets); err != nil {
+		return nil, err
+	}
 
-			content, err := ReadFile(path)
-			if err != nil {
-				return err
-			}
+	return secrets.Secrets, nil
+}
 
-			_, err = sha.Write([]byte(content))
-			return err
-		})
+// Hashes a list of values, the result doesn't depend on the order of the values
+func HashStrings(values ...string) string {
+	sorted := append([]string{}, values...)
+	sort.Strings(sorted)
 
-	return hex.EncodeToString(sha.Sum(nil)), err
+	sha := sha256.New()
+	for _, v := range sorted {
+		_, _ = sha.Write([]byte(v))
+		_, _ = sha.Write([]byte{0})
+	}
+	return hex.EncodeToString(sha.Sum(nil))
 }
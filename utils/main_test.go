@@ -0,0 +1,880 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getsops/sops/v3/decrypt"
+	log "github.com/sirupsen/logrus"
+)
+
+func assert(t *testing.T, v bool, reason string) {
+	if !v {
+		t.Errorf(`Error: %s`, reason)
+	}
+}
+
+func assertEq[K comparable](t *testing.T, got, want K, reason string) {
+	if got != want {
+		t.Errorf(`Error: %s.
+    Got:
+    %+v
+    Expected:
+    %+v`, reason, got, want)
+	}
+}
+
+func TestMergeSopsManifest(t *testing.T) {
+	manifest := Manifest{
+		Container: map[string][]string{
+			"Image":       {"docker.io/library/postgres:16"},
+			"Environment": {"POSTGRES_USER=user", "POSTGRES_PASSWORD=changeme"},
+			"Label":       {"a=b"},
+		},
+		Unit: map[string][]string{
+			"Requires": {"a.service"},
+		},
+	}
+
+	sopsManifest := SopsManifest{
+		Sections: map[string]map[string][]string{
+			"Container": {
+				"Environment!": {"POSTGRES_PASSWORD=secret"},
+				"Label!":       nil,
+				"Secret":       {"db"},
+			},
+			"Unit": {
+				"Requires": {"b.service"},
+			},
+			"Service": {
+				"Environment": {"TOKEN=secret"},
+			},
+		},
+	}
+
+	err := mergeSopsManifest(&manifest, sopsManifest)
+	if err != nil {
+		t.Fatalf("merge failed: %s", err.Error())
+	}
+
+	assertEq(t, len(manifest.Container["Environment"]), 1, "Environment should have been replaced")
+	assertEq(t, manifest.Container["Environment"][0], "POSTGRES_PASSWORD=secret", "Environment should have been replaced")
+	_, ok := manifest.Container["Label"]
+	assert(t, !ok, "Label should have been removed")
+	assertEq(t, manifest.Container["Secret"][0], "db", "Secret should have been added")
+	assertEq(t, len(manifest.Unit["Requires"]), 2, "Requires should have been appended to")
+	assertEq(t, manifest.Unit["Requires"][1], "b.service", "Requires should have been appended to")
+	assertEq(t, manifest.Service["Environment"][0], "TOKEN=secret", "Service section should have been merged")
+}
+
+func TestMergeSopsManifestUnknownSection(t *testing.T) {
+	manifest := newManifest()
+
+	err := mergeSopsManifest(&manifest, SopsManifest{Sections: map[string]map[string][]string{
+		"Containr": {"Environment": {"A=b"}},
+	}})
+
+	assert(t, err != nil, "unknown section should fail the merge")
+
+	err = mergeSopsManifest(&manifest, SopsManifest{Containers: map[string]map[string]map[string][]string{
+		"app": {"Container": {"Environment": {"A=b"}}},
+	}})
+
+	assert(t, err != nil, "unknown container should fail the merge")
+}
+
+func TestMergeSopsManifestPod(t *testing.T) {
+	manifest := Manifest{
+		Containers: map[string]PodContainer{
+			"app": {
+				Container: map[string][]string{
+					"Image": {"docker.io/library/app"},
+				},
+			},
+		},
+	}
+
+	err := mergeSopsManifest(&manifest, SopsManifest{Containers: map[string]map[string]map[string][]string{
+		"app": {
+			"Container": {"Environment": {"A=b"}},
+			"Service":   {"Restart": {"always"}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("merge failed: %s", err.Error())
+	}
+
+	assertEq(t, manifest.Containers["app"].Container["Environment"][0], "A=b", "Environment should have been added to the container")
+	assertEq(t, manifest.Containers["app"].Service["Restart"][0], "always", "Service section should have been merged")
+}
+
+func TestSopsFiles(t *testing.T) {
+	assert(t, !IsSopsFile("manifest.sops.yml"), "the sops manifest should not be decrypted as a file")
+	assert(t, !IsSopsFile("config.json"), "config.json is not a sops file")
+	assert(t, IsSopsFile("config.sops.json"), "config.sops.json is a sops file")
+	assert(t, IsSopsFile(".env.sops"), ".env.sops is a sops file")
+
+	assertEq(t, sopsFileTarget("config.sops.json"), "config.json", "unexpected decrypted file name")
+	assertEq(t, sopsFileTarget(".env.sops"), ".env", "unexpected decrypted file name")
+	assertEq(t, sopsFileTarget("key.sops.pem"), "key.pem", "unexpected decrypted file name")
+
+	assertEq(t, sopsFileFormat("config.sops.json"), "json", "unexpected sops format")
+	assertEq(t, sopsFileFormat("config.sops.yml"), "yaml", "unexpected sops format")
+	assertEq(t, sopsFileFormat(".env.sops"), "dotenv", "unexpected sops format")
+	assertEq(t, sopsFileFormat("key.sops.pem"), "binary", "unexpected sops format")
+}
+
+func TestRenderTemplate(t *testing.T) {
+	vars := map[string]string{
+		"SERVICE": "caddy",
+		"domain":  "example.com",
+	}
+	secrets := map[string]string{
+		"token": "secret",
+	}
+
+	rendered, err := RenderTemplate("Caddyfile.tmpl", `{{ .SERVICE }}.{{ .domain }} {
+	basicauth { user {{ secret "token" }} }
+}
+`, vars, secrets)
+	if err != nil {
+		t.Fatalf("rendering failed: %s", err.Error())
+	}
+	assertEq(t, string(rendered), `caddy.example.com {
+	basicauth { user secret }
+}
+`, "rendered template doesn't match expected output")
+
+	_, err = RenderTemplate("missing.tmpl", `{{ .missing }}`, vars, secrets)
+	assert(t, err != nil, "missing vars should fail rendering")
+
+	_, err = RenderTemplate("missing.tmpl", `{{ secret "missing" }}`, vars, secrets)
+	assert(t, err != nil, "missing secrets should fail rendering")
+
+	serviceDir := t.TempDir()
+	renderedDir := filepath.Join(t.TempDir(), "rendered")
+	os.WriteFile(filepath.Join(serviceDir, "token.tmpl"), []byte(`{{ secret "token" }}`), 0600)
+	_, err = RenderServiceTemplates(serviceDir, renderedDir, vars, secrets)
+	assert(t, err == nil, "rendering the service templates failed")
+	info, err := os.Stat(filepath.Join(renderedDir, "token"))
+	assert(t, err == nil, "rendered file should exist")
+	assertEq(t, info.Mode().Perm(), os.FileMode(0600), "rendered files should only be readable by the user")
+}
+
+func TestValidateHost(t *testing.T) {
+	hostDir := t.TempDir()
+
+	files := map[string]string{
+		"config.yml": `services:
+  service_a: {}
+  service_b:
+    vars: {}
+`,
+		"service_a/manifest.yml": `Container:
+  Imgae:
+    - "docker.io/library/caddy:2.5.2-alpine"
+Volumes:
+  - "/data:/data"
+Unit:
+  ConditionPathExists:
+    - /data
+Service:
+  ExecStrat:
+    - /bin/true
+  MemoryMaxx:
+    - 1G
+  MemoryMax:
+    - 1G
+  LimitNOFILE:
+    - "1024"
+`,
+		"service_b/manifest.yml": `Container:
+  Image: "docker.io/library/caddy:2.5.2-alpine"
+`,
+		"service_b/manifest.sops.yml": `Container:
+  Environment!:
+    - ENC[AES256_GCM,data:abc]
+  Enviroment:
+    - ENC[AES256_GCM,data:abc]
+secrets:
+  a: ENC[AES256_GCM,data:abc]
+sops:
+  version: 3.8.0
+`,
+	}
+	for file, content := range files {
+		path := fmt.Sprintf("%s/%s", hostDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := ValidateHost(hostDir)
+
+	expected := []string{
+		fmt.Sprintf("%s/service_a/manifest.yml:2:3: unknown key 'Imgae' in section 'Container'", hostDir),
+		fmt.Sprintf("%s/service_a/manifest.yml:4:1: unknown section 'Volumes'", hostDir),
+		fmt.Sprintf("%s/service_a/manifest.yml:10:3: unknown key 'ExecStrat' in section 'Service'", hostDir),
+		fmt.Sprintf("%s/service_a/manifest.yml:12:3: unknown key 'MemoryMaxx' in section 'Service'", hostDir),
+		fmt.Sprintf("%s/service_b/manifest.yml:2:10: expected a list of values for 'Image'", hostDir),
+		fmt.Sprintf("%s/service_b/manifest.sops.yml:4:3: unknown key 'Enviroment' in section 'Container'", hostDir),
+	}
+	assertEq(t, len(errs), len(expected), "unexpected number of validation errors")
+	for i := range expected {
+		if i < len(errs) {
+			assertEq(t, errs[i].Error(), expected[i], "unexpected validation error")
+		}
+	}
+
+	os.WriteFile(fmt.Sprintf("%s/config.yml", hostDir), []byte("services:\n  service_a: {}\nservice:\n  service_b: {}\n"), 0600)
+	errs = ValidateHost(hostDir)
+	assertEq(t, len(errs), 1, "expected unknown key in config to fail")
+	if len(errs) == 1 {
+		assertEq(t, errs[0].Error(), fmt.Sprintf("%s/config.yml:3:1: unknown key 'service' in config", hostDir), "unexpected validation error")
+	}
+
+	os.WriteFile(fmt.Sprintf("%s/config.yml", hostDir), []byte("images:\n  caddy:\n    Imag:\n      - docker.io/library/caddy:2\nservices:\n  service_a: {}\n"), 0600)
+	errs = ValidateHost(hostDir)
+	assertEq(t, len(errs), 2, "expected unknown key and missing Image in image to fail")
+	if len(errs) == 2 {
+		assertEq(t, errs[0].Error(), fmt.Sprintf("%s/config.yml:3:5: unknown key 'Imag' in image 'caddy'", hostDir), "unexpected validation error")
+		assertEq(t, errs[1].Error(), fmt.Sprintf("%s/config.yml:2:3: image 'caddy' doesn't have an Image", hostDir), "unexpected validation error")
+	}
+
+	os.WriteFile(fmt.Sprintf("%s/config.yml", hostDir), []byte("services: {}\nworkers: -1\n"), 0600)
+	errs = ValidateHost(hostDir)
+	assertEq(t, len(errs), 1, "expected an invalid value in config to fail")
+	if len(errs) == 1 {
+		assertEq(t, errs[0].Error(), fmt.Sprintf("%s/config.yml:2:1: workers can't be negative", hostDir), "unexpected validation error")
+	}
+}
+
+func TestBuildFields(t *testing.T) {
+	fields, err := BuildFields(map[string][]string{
+		"Volume":      {"%h/data:/data", "${DIR}:/config"},
+		"Environment": {"A=${A}", "B=${UNKNOWN}"},
+	}, map[string]string{
+		"DIR": "/var/mnt/100%",
+		"A":   "${DIR}",
+	})
+	if err != nil {
+		t.Fatalf("BuildFields failed: %s", err.Error())
+	}
+	assertEq(t, fields, `Environment=A=${DIR}
+Environment=B=${UNKNOWN}
+Volume=%h/data:/data
+Volume=/var/mnt/100%%:/config
+`, "specifiers in variables should be escaped, and variables should only be replaced once")
+
+	_, err = BuildFields(map[string][]string{
+		"Environment": {"A=${A}"},
+	}, map[string]string{
+		"A": "a\n[Service]\nExecStartPre=/bin/sh -c 'id'",
+	})
+	assert(t, err != nil, "newlines in variables should fail")
+
+	_, err = BuildFields(map[string][]string{
+		"Environment": {"A=a\nExecStartPre=/bin/sh"},
+	}, map[string]string{})
+	assert(t, err != nil, "newlines in values should fail")
+
+	_, err = BuildFields(map[string][]string{
+		"Environment": {"A=a\\"},
+	}, map[string]string{})
+	assert(t, err != nil, "values ending with a backslash should fail")
+
+	_, err = BuildFields(map[string][]string{
+		"Exec=/bin/sh": {"a"},
+	}, map[string]string{})
+	assert(t, err != nil, "keys containing = should fail")
+}
+
+func TestValidateName(t *testing.T) {
+	assert(t, ValidateName("service", "service_a-1") == nil, "service_a-1 should be a valid name")
+	assert(t, ValidateName("service", "../../other") != nil, "paths should not be valid names")
+	assert(t, ValidateName("service", "a/b") != nil, "paths should not be valid names")
+	assert(t, ValidateName("service", "a.service") != nil, "unit suffixes should not be valid names")
+	assert(t, ValidateName("service", "-a") != nil, "names starting with - should not be valid")
+	assert(t, ValidateName("service", "_a") != nil, "names starting with _ should not be valid")
+	assert(t, ValidateName("service", "") != nil, "empty names should not be valid")
+}
+
+func TestValidateHostname(t *testing.T) {
+	assert(t, ValidateHostname("nas") == nil, "nas should be a valid host name")
+	assert(t, ValidateHostname("nas.lan") == nil, "fully qualified domain names should be valid host names")
+	assert(t, ValidateHostname("host-1.example.com") == nil, "fully qualified domain names should be valid host names")
+	assert(t, ValidateHostname("..") != nil, "paths should not be valid host names")
+	assert(t, ValidateHostname("a/b") != nil, "paths should not be valid host names")
+	assert(t, ValidateHostname(".lan") != nil, "empty labels should not be valid")
+	assert(t, ValidateHostname("-nas") != nil, "labels starting with - should not be valid")
+	assert(t, ValidateHostname("") != nil, "empty host names should not be valid")
+}
+
+func TestJoinInside(t *testing.T) {
+	base := t.TempDir()
+	other := t.TempDir()
+
+	if err := os.Symlink(other, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := JoinInside(base, "service_a")
+	assert(t, err == nil, "path inside base should be allowed")
+	assertEq(t, path, filepath.Join(base, "service_a"), "unexpected joined path")
+
+	_, err = JoinInside(base, "../other")
+	assert(t, err != nil, "path outside of base should not be allowed")
+
+	_, err = JoinInside(base, "link")
+	assert(t, err != nil, "symlink to a path outside of base should not be allowed")
+
+	_, err = JoinInside(base, "link/service_a")
+	assert(t, err != nil, "path through a symlink outside of base should not be allowed")
+
+	_, err = JoinInside(base, ".")
+	assert(t, err != nil, "base itself should not be allowed")
+}
+
+func TestValidateService(t *testing.T) {
+	valid := []Service{
+		{},
+		{Kind: SERVICE_KIND_SERVICE},
+		{Kind: SERVICE_KIND_JOB, Schedule: "daily"},
+		{ImageUpdates: IMAGE_UPDATES_NOTIFY},
+	}
+	for _, service := range valid {
+		assert(t, service.validate() == nil, fmt.Sprintf("expected service %+v to be valid", service))
+	}
+
+	invalid := []Service{
+		{Kind: SERVICE_KIND_JOB},
+		{Schedule: "daily"},
+		{Kind: "cron", Schedule: "daily"},
+		{Kind: SERVICE_KIND_JOB, Schedule: "daily\n"},
+		{ImageUpdates: "always"},
+	}
+	for _, service := range invalid {
+		assert(t, service.validate() != nil, fmt.Sprintf("expected service %+v to be invalid", service))
+	}
+}
+
+func TestHashDir(t *testing.T) {
+	writeDir := func(dir string) {
+		files := map[string]string{
+			"manifest.yml":        "Container: {}\n",
+			"config/app.conf":     "a = b\n",
+			"README.md":           "notes\n",
+			"docs/setup.md":       "setup\n",
+			"Caddyfile.tmpl":      "{{ .SERVICE }}\n",
+			HASH_IGNORE_FILE:      "# notes\n*.md\ndocs/\n",
+			"config/nested/a.txt": "a\n",
+		}
+		for file, content := range files {
+			path := filepath.Join(dir, file)
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("config/app.conf", filepath.Join(dir, "app.conf")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(dir string) string {
+		h, err := HashDir(dir, HashOptions{Exclude: IsTemplateFile})
+		if err != nil {
+			t.Fatalf("hashing dir failed: %s", err.Error())
+		}
+		return h
+	}
+
+	dirA := t.TempDir()
+	dirB := filepath.Join(t.TempDir(), "other", "location")
+	writeDir(dirA)
+	writeDir(dirB)
+
+	original := hash(dirA)
+	assertEq(t, hash(dirB), original, "hash shouldn't depend on the location of the dir")
+
+	os.WriteFile(filepath.Join(dirA, "README.md"), []byte("changed\n"), 0600)
+	os.WriteFile(filepath.Join(dirA, "docs/setup.md"), []byte("changed\n"), 0600)
+	os.WriteFile(filepath.Join(dirA, "Caddyfile.tmpl"), []byte("changed\n"), 0600)
+	assertEq(t, hash(dirA), original, "ignored and excluded files shouldn't change the hash")
+
+	os.WriteFile(filepath.Join(dirA, "config/nested/a.txt"), []byte("changed\n"), 0600)
+	assert(t, hash(dirA) != original, "changing a nested file should change the hash")
+
+	os.Chmod(filepath.Join(dirB, "config/app.conf"), 0640)
+	os.Chmod(filepath.Join(dirB, "config"), 0750)
+	assertEq(t, hash(dirB), original, "permissions other than the executable bit shouldn't change the hash")
+
+	os.Chmod(filepath.Join(dirB, "config/app.conf"), 0700)
+	modeChanged := hash(dirB)
+	assert(t, modeChanged != original, "making a file executable should change the hash")
+
+	os.Remove(filepath.Join(dirB, "app.conf"))
+	os.Symlink("config/nested/a.txt", filepath.Join(dirB, "app.conf"))
+	assert(t, hash(dirB) != modeChanged, "changing the target of a symlink should change the hash")
+
+	os.WriteFile(filepath.Join(dirB, HASH_IGNORE_FILE), []byte("!README.md\n"), 0600)
+	_, err := HashDir(dirB, HashOptions{})
+	assert(t, err != nil, "negated patterns should be rejected")
+}
+
+func TestHashDirSops(t *testing.T) {
+	decrypted := map[string]string{}
+	decryptFile = func(path string, format string) ([]byte, error) {
+		return []byte(decrypted[filepath.Base(path)]), nil
+	}
+	defer func() { decryptFile = decrypt.File }()
+
+	dir := t.TempDir()
+	write := func(name string, ciphertext string, plaintext string) {
+		os.WriteFile(filepath.Join(dir, name), []byte(ciphertext), 0600)
+		decrypted[name] = plaintext
+	}
+	hash := func(salt []byte) string {
+		h, err := HashDir(dir, HashOptions{SopsSalt: salt})
+		if err != nil {
+			t.Fatalf("hashing dir failed: %s", err.Error())
+		}
+		return h
+	}
+	salt := []byte("salt")
+
+	write("manifest.sops.yml", "ENC[a]", "Container:\n  Environment:\n    - A=b\n")
+	write("config.sops.json", "ENC[b]", `{"b": 1, "a": 2}`)
+	original := hash(salt)
+
+	write("manifest.sops.yml", "ENC[c]", "Container:\n    Environment: [\"A=b\"]\n")
+	write("config.sops.json", "ENC[d]", `{"a": 2, "b": 1}`)
+	assertEq(t, hash(salt), original, "re-encrypting sops files shouldn't change the hash")
+
+	write("config.sops.json", "ENC[e]", `{"a": 3, "b": 1}`)
+	assert(t, hash(salt) != original, "changing a secret should change the hash")
+	assert(t, hash([]byte("other")) != hash(salt), "the hash should depend on the salt")
+
+	sopsHashes := func() []string {
+		hashes, err := SopsHashes(dir, HashOptions{SopsSalt: salt, Only: []string{"config.sops.json"}})
+		if err != nil {
+			t.Fatalf("hashing sops files failed: %s", err.Error())
+		}
+		return hashes
+	}
+	hashes := sopsHashes()
+	assertEq(t, len(hashes), 1, "only the included sops files should be hashed")
+	assert(t, strings.HasPrefix(hashes[0], "sops:config.sops.json="), "sops hashes should have the path of the file")
+	write("config.sops.json", "ENC[f]", `{"b": 1, "a": 3}`)
+	assertEq(t, sopsHashes()[0], hashes[0], "re-encrypting sops files shouldn't change the sops hashes")
+
+	t.Setenv("HOME", t.TempDir())
+	saltA, err := HashSalt()
+	assert(t, err == nil, "creating hash salt failed")
+	saltB, err := HashSalt()
+	assert(t, err == nil, "reading hash salt failed")
+	assertEq(t, string(saltA), string(saltB), "hash salt should be persisted")
+	info, _ := os.Stat(fmt.Sprintf(HASH_SALT_FILE_PATH, os.Getenv("HOME")))
+	assertEq(t, info.Mode().Perm(), os.FileMode(0600), "hash salt should only be readable by the user")
+}
+
+func TestSharedFiles(t *testing.T) {
+	sharedName := filepath.Base(fmt.Sprintf(HOST_SHARED_DIR, ""))
+	assert(t, ValidateName("service", sharedName) != nil, "the shared dir shouldn't be a valid service name")
+
+	sharedDir := t.TempDir()
+	for file, content := range map[string]string{"certs/ca.pem": "ca\n", "proxy.conf": "a = b\n", "unused.conf": "c\n"} {
+		path := filepath.Join(sharedDir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	references := SharedReferences(sharedDir,
+		"${SHARED_DIR}/proxy.conf:/etc/proxy.conf:ro,z",
+		fmt.Sprintf("ca_file = %s/certs/ca.pem", sharedDir),
+		"${SHARED_DIR}/certs/./ca.pem:/ca.pem",
+		"${SERVICE_DIR}/unused.conf",
+	)
+	assertEq(t, strings.Join(references, ","), "certs/ca.pem,proxy.conf", "references")
+
+	hash := func() string {
+		hashes, err := HashSharedFiles(sharedDir, references, HashOptions{})
+		if err != nil {
+			t.Fatalf("hashing shared files failed: %s", err.Error())
+		}
+		return strings.Join(hashes, ",")
+	}
+	original := hash()
+
+	if err := os.WriteFile(filepath.Join(sharedDir, "unused.conf"), []byte("d\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, hash(), original, "unreferenced files shouldn't change the hash")
+
+	if err := os.WriteFile(filepath.Join(sharedDir, "proxy.conf"), []byte("a = c\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, hash() != original, "referenced files should change the hash")
+
+	whole := SharedReferences(sharedDir, "${SHARED_DIR}:/shared:ro", "${SHARED_DIR}/proxy.conf:/etc/proxy.conf")
+	assertEq(t, strings.Join(whole, ","), ".", "a reference to the shared dir should depend on all of it")
+	wholeHash := func() string {
+		hashes, err := HashSharedFiles(sharedDir, whole, HashOptions{})
+		if err != nil {
+			t.Fatalf("hashing the shared dir failed: %s", err.Error())
+		}
+		return strings.Join(hashes, ",")
+	}
+	original = wholeHash()
+	if err := os.WriteFile(filepath.Join(sharedDir, "unused.conf"), []byte("e\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, wholeHash() != original, "any file in the shared dir should change the hash of the whole dir")
+
+	_, err := HashSharedFiles(sharedDir, []string{"missing.conf"}, HashOptions{})
+	assert(t, err != nil, "missing shared files should fail")
+	_, err = HashSharedFiles(sharedDir, SharedReferences(sharedDir, "${SHARED_DIR}/../secrets"), HashOptions{})
+	assert(t, err != nil, "references outside the shared dir should fail")
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	for file, content := range map[string]string{"manifest.yml": "Container: {}\n", "conf.d/site.conf": "a\n", "Caddyfile": "b\n"} {
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := Reload{Files: []string{"conf.d/", "Caddyfile"}, Signal: "SIGHUP"}
+	hash := func(options HashOptions) string {
+		h, err := HashDir(dir, options)
+		if err != nil {
+			t.Fatalf("hashing dir failed: %s", err.Error())
+		}
+		return h
+	}
+	serviceHash := hash(HashOptions{Ignore: reload.Files})
+	configHash := hash(HashOptions{Only: reload.Files})
+
+	if err := os.WriteFile(filepath.Join(dir, "conf.d/site.conf"), []byte("c\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assertEq(t, hash(HashOptions{Ignore: reload.Files}), serviceHash, "reloadable files shouldn't change the service hash")
+	assert(t, hash(HashOptions{Only: reload.Files}) != configHash, "reloadable files should change the config hash")
+
+	if err := os.WriteFile(filepath.Join(dir, "manifest.yml"), []byte("Container: {Image: [app]}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, hash(HashOptions{Ignore: reload.Files}) != serviceHash, "other files should change the service hash")
+
+	assert(t, reload.Reloadable("conf.d/nested/site.conf"), "files in reloadable dirs should be reloadable")
+	assert(t, !reload.Reloadable("other.conf"), "other files shouldn't be reloadable")
+
+	pod := Manifest{Containers: map[string]PodContainer{"proxy": {}}}
+	for _, c := range []struct {
+		reload   Reload
+		manifest Manifest
+		valid    bool
+	}{
+		{Reload{}, Manifest{}, true},
+		{reload, Manifest{}, true},
+		{Reload{Files: []string{"Caddyfile"}, Exec: []string{"caddy", "reload"}, Container: "proxy"}, pod, true},
+		{Reload{Files: []string{"Caddyfile"}, ExecReload: []string{"/bin/kill -HUP $MAINPID"}}, Manifest{}, true},
+		{Reload{Signal: "SIGHUP"}, Manifest{}, false},
+		{Reload{Files: []string{"Caddyfile"}}, Manifest{}, false},
+		{Reload{Files: []string{"Caddyfile"}, Signal: "SIGHUP", Exec: []string{"reload"}}, Manifest{}, false},
+		{Reload{Files: []string{"Caddyfile"}, ExecReload: []string{"reload"}}, pod, false},
+		{Reload{Files: []string{"Caddyfile"}, Signal: "SIGHUP", Container: "other"}, pod, false},
+		{Reload{Files: []string{"[Caddyfile"}, Signal: "SIGHUP"}, Manifest{}, false},
+	} {
+		err := c.reload.validate(c.manifest)
+		assertEq(t, err == nil, c.valid, fmt.Sprintf("validating reload %+v", c.reload))
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	assertEq(t, Config{}.WorkerCount(), DEFAULT_WORKERS, "workers should default to DEFAULT_WORKERS")
+	assertEq(t, Config{Workers: 1}.WorkerCount(), 1, "workers should be used if set")
+	assert(t, Config{Workers: 8}.Validate() == nil, "positive workers should be valid")
+	assert(t, Config{Workers: -1}.Validate() != nil, "negative workers should be invalid")
+}
+
+func TestHashDirGit(t *testing.T) {
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		output, err := RunCommand(repo, os.Environ(), false, "git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)...)
+		if err != nil {
+			t.Fatalf("git %v failed: %s", args, err.Error())
+		}
+		return strings.TrimSpace(output)
+	}
+	write := func(file string, content string) {
+		path := filepath.Join(repo, "service", file)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(options HashOptions) string {
+		options.Git = true
+		h, err := HashDir(filepath.Join(repo, "service"), options)
+		if err != nil {
+			t.Fatalf("hashing dir failed: %s", err.Error())
+		}
+		return h
+	}
+
+	git("init", "--quiet")
+	write("manifest.yml", "Container: {}\n")
+	write("conf.d/site.conf", "a\n")
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "first")
+
+	assertEq(t, hash(HashOptions{}), git("rev-parse", "HEAD:service"), "hash should be the tree ID")
+	assertEq(t, hash(HashOptions{Exclude: IsTemplateFile}), git("rev-parse", "HEAD:service"), "hash should be the tree ID if nothing is excluded")
+
+	serviceHash := hash(HashOptions{Ignore: []string{"conf.d/"}})
+	configHash := hash(HashOptions{Only: []string{"conf.d/"}})
+	write("conf.d/site.conf", "b\n")
+	git("commit", "--quiet", "-am", "second")
+	assertEq(t, hash(HashOptions{Ignore: []string{"conf.d/"}}), serviceHash, "ignored files shouldn't change the hash")
+	assert(t, hash(HashOptions{Only: []string{"conf.d/"}}) != configHash, "included files should change the hash")
+
+	if err := os.WriteFile(filepath.Join(repo, ".gitignore"), []byte("*.env\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	write("local.env", "A=b\n")
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "third")
+	_, err := HashDir(filepath.Join(repo, "service"), HashOptions{Git: true})
+	assert(t, err != nil, "files ignored by git should fail")
+	write(HASH_IGNORE_FILE, "local.env\n")
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "fourth")
+	_, err = HashDir(filepath.Join(repo, "service"), HashOptions{Git: true})
+	assert(t, err == nil, "files ignored by git and by the ignore file should be allowed")
+
+	write("manifest.yml", "Container: {Image: [app]}\n")
+	_, err = HashDir(filepath.Join(repo, "service"), HashOptions{Git: true})
+	assert(t, err != nil, "uncommitted changes should fail")
+
+	assert(t, Config{Hashing: HASHING_GIT}.Validate() == nil, "git hashing should be valid")
+	assert(t, Config{Hashing: "sha1"}.Validate() != nil, "unknown hashing should be invalid")
+}
+
+func TestMassRemovalMarker(t *testing.T) {
+	dir := t.TempDir()
+	configFile := fmt.Sprintf(CONFIG_FILE_PATH, dir)
+	if err := os.WriteFile(configFile, []byte("services: {}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := ReadConfigFile(configFile)
+	assert(t, err == nil, "reading the config failed")
+	assertEq(t, len(config.AllowedRemovals), 0, "no services should be allowed without the marker")
+
+	marker := "# removed with the old host\nservice-a\n\n  service-b  \n"
+	if err := os.WriteFile(fmt.Sprintf(MASS_REMOVAL_MARKER_FILE, dir), []byte(marker), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = ReadConfigFile(configFile)
+	assertEq(t, strings.Join(config.AllowedRemovals, ","), "service-a,service-b", "services should be read from the marker")
+
+	if err := os.WriteFile(configFile, []byte("services: {}\nmassRemoval:\n  maxServices: 10\n  maxPercent: 80\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = ReadConfigFile(configFile)
+	assertEq(t, config.MassRemovalLimits(), MassRemoval{MaxServices: 10, MaxPercent: 80, MinServices: DEFAULT_MASS_REMOVAL_MIN_SERVICES}, "limits should be read from the config")
+	assertEq(t, len(validateConfig(configFile)), 0, "massRemoval should be a valid config key")
+
+	if err := os.WriteFile(configFile, []byte("services: {}\nmassRemoval:\n  maxServices: 0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ = ReadConfigFile(configFile)
+	assertEq(t, config.MassRemovalLimits().MaxServices, 0, "0 should be a valid limit")
+	assert(t, config.Validate() == nil, "0 should be a valid limit")
+
+	minServices, maxPercent := -1, 101
+	assert(t, Config{MassRemoval: MassRemovalConfig{MinServices: &minServices}}.Validate() != nil, "negative limits should be invalid")
+	assert(t, Config{MassRemoval: MassRemovalConfig{MaxPercent: &maxPercent}}.Validate() != nil, "more than 100 percent should be invalid")
+}
+
+func TestSaltedHash(t *testing.T) {
+	a := SaltedHash([]byte("password"), []byte("salt-a"))
+	assertEq(t, a, SaltedHash([]byte("password"), []byte("salt-a")), "the hash should be stable")
+	assert(t, a != SaltedHash([]byte("password"), []byte("salt-b")), "the hash should depend on the salt")
+	assert(t, a != HashStrings("password"), "the hash should be salted")
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	configFile := fmt.Sprintf(CONFIG_FILE_PATH, t.TempDir())
+	os.WriteFile(configFile, []byte("services:\n  service_a:\n    vars: [a]\n"), 0600)
+
+	_, err := ReadConfigFile(configFile)
+	assert(t, err != nil, "invalid config should fail")
+	if err != nil {
+		assert(t, strings.HasPrefix(err.Error(), fmt.Sprintf("%s:3:1: ", configFile)), "error should have the location in the config")
+	}
+}
+
+func TestRunCommandLog(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&out)
+	entry := logger.WithField("service", "a")
+
+	_, err := RunCommandLog(entry, "", os.Environ(), "true")
+	assert(t, err == nil, "command succeeds")
+	_, err = RunCommandLog(entry, "", os.Environ(), "sh", "-c", "echo failed >&2; exit 1")
+	assert(t, err != nil, "command fails")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assertEq(t, len(lines), 3, "both commands and the failure are logged")
+	for _, line := range lines {
+		assert(t, strings.Contains(line, "service=a"), fmt.Sprintf("'%s' is logged with the service", line))
+	}
+	assert(t, strings.Contains(lines[2], "failed"), "the stderr of the failed command is logged")
+}
+
+// Decrypts files written as "ENC:<plaintext>", and fails for other files
+func stubDecryptFile(t *testing.T) {
+	decryptFile = func(path string, format string) ([]byte, error) {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(string(content), "ENC:") {
+			return nil, fmt.Errorf("not encrypted")
+		}
+		return []byte(strings.TrimPrefix(string(content), "ENC:")), nil
+	}
+	t.Cleanup(func() { decryptFile = decrypt.File })
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for rel, content := range files {
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDecryptServiceFiles(t *testing.T) {
+	stubDecryptFile(t)
+
+	for _, c := range []struct {
+		name  string
+		files map[string]string
+		// Decrypted files in the secrets dir, nil if decrypting should fail
+		want map[string]string
+	}{
+		{"no sops files", map[string]string{"app.conf": "a"}, map[string]string{}},
+		{"sops files", map[string]string{"config.sops.json": "ENC:{}", ".env.sops": "ENC:A=b", "app.conf": "a"}, map[string]string{"config.json": "{}", ".env": "A=b"}},
+		{"nested sops files", map[string]string{"conf/site.sops.yml": "ENC:a: b"}, map[string]string{"conf/site.yml": "a: b"}},
+		{"sops manifest", map[string]string{"manifest.sops.yml": "ENC:secrets: {}"}, map[string]string{}},
+		{"not encrypted", map[string]string{"config.sops.json": "{}"}, nil},
+	} {
+		serviceDir := t.TempDir()
+		secretsDir := filepath.Join(t.TempDir(), "secrets")
+		writeFiles(t, serviceDir, c.files)
+		// Left over from a sops file that was removed
+		writeFiles(t, secretsDir, map[string]string{"old.json": "{}"})
+
+		err := DecryptServiceFiles(serviceDir, secretsDir)
+		if c.want == nil {
+			assert(t, err != nil, fmt.Sprintf("%s: decrypting should fail", c.name))
+			continue
+		}
+		assert(t, err == nil, fmt.Sprintf("%s: decrypting failed", c.name))
+
+		got := map[string]string{}
+		filepath.Walk(secretsDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+			rel, _ := filepath.Rel(secretsDir, path)
+			content, _ := os.ReadFile(path)
+			got[rel] = string(content)
+			assertEq(t, info.Mode().Perm(), os.FileMode(0600), fmt.Sprintf("%s: '%s' should only be readable by the user", c.name, rel))
+			return nil
+		})
+		assertEq(t, fmt.Sprint(got), fmt.Sprint(c.want), fmt.Sprintf("%s: decrypted files", c.name))
+	}
+}
+
+func TestReadSopsManifest(t *testing.T) {
+	stubDecryptFile(t)
+
+	for _, c := range []struct {
+		name    string
+		content string
+		// Printed secrets, sections and containers
+		want  string
+		valid bool
+	}{
+		{"no sops manifest", "", "map[] map[] map[]", true},
+		{"secrets", "ENC:secrets: {db: pw}", "map[db:pw] map[] map[]", true},
+		{"sections", "ENC:Container: {Environment: [A=b]}", "map[] map[Container:map[Environment:[A=b]]] map[]", true},
+		{"containers", "ENC:Containers: {proxy: {Container: {Environment: [A=b]}}}", "map[] map[] map[proxy:map[Container:map[Environment:[A=b]]]]", true},
+		{"not encrypted", "secrets: {db: pw}", "", false},
+		{"invalid yaml", "ENC:secrets: [", "", false},
+	} {
+		serviceDir := t.TempDir()
+		if c.content != "" {
+			writeFiles(t, serviceDir, map[string]string{filepath.Base(SERVICE_MANIFEST_SOPS_FILE): c.content})
+		}
+
+		sopsManifest, err := ReadSopsManifest(serviceDir)
+		assertEq(t, err == nil, c.valid, fmt.Sprintf("%s: reading the sops manifest", c.name))
+		if err == nil {
+			got := fmt.Sprint(sopsManifest.Secrets, " ", sopsManifest.Sections, " ", sopsManifest.Containers)
+			assertEq(t, got, c.want, fmt.Sprintf("%s: sops manifest", c.name))
+		}
+	}
+}
+
+func TestReadHostSecrets(t *testing.T) {
+	stubDecryptFile(t)
+
+	for _, c := range []struct {
+		name    string
+		content string
+		want    string
+		valid   bool
+	}{
+		{"no secrets file", "", "map[]", true},
+		{"secrets", "ENC:secrets: {db: pw, api: key}", "map[api:key db:pw]", true},
+		{"not encrypted", "secrets: {db: pw}", "", false},
+	} {
+		hostDir := t.TempDir()
+		if c.content != "" {
+			writeFiles(t, hostDir, map[string]string{filepath.Base(HOST_SECRETS_SOPS_FILE): c.content})
+		}
+
+		secrets, err := ReadHostSecrets(hostDir)
+		assertEq(t, err == nil, c.valid, fmt.Sprintf("%s: reading the host secrets", c.name))
+		if err == nil {
+			assertEq(t, fmt.Sprint(secrets), c.want, fmt.Sprintf("%s: host secrets", c.name))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Names of services, networks, volumes and images are used in paths and unit names (gitops-$NAME.service), so they are
+// limited to characters that are safe in both
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+func ValidateName(kind string, name string) error {
+	if !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid %s name '%s', must match %s", kind, name, namePattern.String())
+	}
+	return nil
+}
+
+// Host names are only used in the path of the host dir, so they can be fully qualified domain names like nas.lan
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+func ValidateHostname(name string) error {
+	if len(name) > 253 || !hostnamePattern.MatchString(name) {
+		return fmt.Errorf("invalid host name '%s', must be a host name or a fully qualified domain name", name)
+	}
+	return nil
+}
+
+// Checks the names of the services, networks, volumes and images in the config, and the settings of the services
+func (config Config) Validate() error {
+	for name, service := range config.Services {
+		if err := ValidateName("service", name); err != nil {
+			return err
+		}
+		if err := service.validate(); err != nil {
+			return fmt.Errorf("service '%s': %s", name, err.Error())
+		}
+	}
+	for name := range config.Networks {
+		if err := ValidateName("network", name); err != nil {
+			return err
+		}
+	}
+	for name := range config.Volumes {
+		if err := ValidateName("volume", name); err != nil {
+			return err
+		}
+	}
+	for name, image := range config.Images {
+		if err := ValidateName("image", name); err != nil {
+			return err
+		}
+		if len(image["Image"]) != 1 {
+			return fmt.Errorf("image '%s' must have exactly one Image", name)
+		}
+	}
+	if config.Workers < 0 {
+		return fmt.Errorf("workers can't be negative")
+	}
+	limits := config.MassRemovalLimits()
+	if limits.MaxServices < 0 || limits.MaxPercent < 0 || limits.MinServices < 0 {
+		return fmt.Errorf("massRemoval limits can't be negative")
+	}
+	if limits.MaxPercent > 100 {
+		return fmt.Errorf("massRemoval maxPercent can't be more than 100")
+	}
+	if config.Hashing != "" && config.Hashing != HASHING_CONTENT && config.Hashing != HASHING_GIT {
+		return fmt.Errorf("hashing must be '%s' or '%s'", HASHING_CONTENT, HASHING_GIT)
+	}
+	return nil
+}
+
+// Checks the kind of the service, and the other settings that depend on it
+func (service Service) validate() error {
+	switch service.Kind {
+	case "", SERVICE_KIND_SERVICE:
+		if service.Schedule != "" {
+			return fmt.Errorf("schedule can only be used for jobs")
+		}
+	case SERVICE_KIND_JOB:
+		if service.Schedule == "" {
+			return fmt.Errorf("jobs must have a schedule")
+		}
+		if err := CheckUnitValue(service.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule: %s", err.Error())
+		}
+	default:
+		return fmt.Errorf("unknown kind '%s', must be '%s' or '%s'", service.Kind, SERVICE_KIND_SERVICE, SERVICE_KIND_JOB)
+	}
+
+	switch service.ImageUpdates {
+	case "", IMAGE_UPDATES_RESTART, IMAGE_UPDATES_NOTIFY, IMAGE_UPDATES_IGNORE:
+	default:
+		return fmt.Errorf("unknown imageUpdates '%s', must be '%s', '%s' or '%s'", service.ImageUpdates, IMAGE_UPDATES_RESTART, IMAGE_UPDATES_NOTIFY, IMAGE_UPDATES_IGNORE)
+	}
+	return nil
+}
+
+// Resolves symlinks in the path, or in the closest parent that exists, so paths that don't exist yet can be checked
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) || filepath.Dir(path) == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = filepath.Dir(path)
+	}
+}
+
+// Checks that the path, with symlinks resolved, is inside base
+func CheckInside(base string, path string) error {
+	resolvedBase, err := resolvePath(base)
+	if err != nil {
+		return err
+	}
+	resolvedPath, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(resolvedPath, resolvedBase+string(filepath.Separator)) {
+		return fmt.Errorf("path '%s' is outside of '%s'", path, base)
+	}
+	return nil
+}
+
+// Joins the elements to base, and checks that the resulting path is inside base
+func JoinInside(base string, elem ...string) (string, error) {
+	path := filepath.Join(append([]string{base}, elem...)...)
+	return path, CheckInside(base, path)
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Key in the manifest with how the service reloads its config
+var MANIFEST_RELOAD_KEY = "reload"
+
+// How a service reloads the files it can use without restarting. The files are hashed separately from the rest of
+// the service, so when only they change the service is reloaded instead of restarted.
+type Reload struct {
+	// Patterns like in .gitopsignore for the files that can be reloaded, relative to the service dir. Rendered
+	// templates match by their name without the .tmpl suffix.
+	Files []string `yaml:"files"`
+
+	// Exactly one of these is used to reload the service. Signal is sent to the containers, Exec is run in the
+	// containers with podman exec, and ExecReload is added to the [Service] section and run with systemctl reload.
+	Signal     string   `yaml:"signal"`
+	Exec       []string `yaml:"exec"`
+	ExecReload []string `yaml:"execReload"`
+
+	// For pods, the container that Signal or Exec is used for, all the containers are used if it isn't set
+	Container string `yaml:"container"`
+}
+
+func (r Reload) IsSet() bool {
+	return len(r.Files) > 0
+}
+
+// Returns true if the path, relative to the service dir or the rendered dir, is one of the files that can be reloaded
+func (r Reload) Reloadable(rel string) bool {
+	return ignorePatterns(r.Files).matchPath(filepath.ToSlash(rel), false)
+}
+
+func (r Reload) validate(manifest Manifest) error {
+	methods := 0
+	for _, set := range []bool{r.Signal != "", len(r.Exec) > 0, len(r.ExecReload) > 0} {
+		if set {
+			methods++
+		}
+	}
+	if !r.IsSet() {
+		if methods > 0 || r.Container != "" {
+			return fmt.Errorf("reload: files must be set")
+		}
+		return nil
+	}
+	if methods != 1 {
+		return fmt.Errorf("reload: exactly one of signal, exec and execReload must be set")
+	}
+
+	for _, pattern := range r.Files {
+		if _, err := filepath.Match(strings.TrimPrefix(pattern, "/"), ""); err != nil || pattern == "" {
+			return fmt.Errorf("reload: invalid pattern '%s'", pattern)
+		}
+	}
+	if r.Signal != "" && strings.ContainsAny(r.Signal, " \t") {
+		return fmt.Errorf("reload: invalid signal '%s'", r.Signal)
+	}
+	if len(r.ExecReload) > 0 && manifest.IsPod() {
+		return fmt.Errorf("reload: execReload can't be used for pods")
+	}
+	if r.Container != "" {
+		if len(r.ExecReload) > 0 {
+			return fmt.Errorf("reload: container can't be used with execReload")
+		}
+		if _, ok := manifest.Containers[r.Container]; !ok {
+			return fmt.Errorf("reload: unknown container '%s'", r.Container)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// Relative to hostGitopsDir, files that can be used by all the services on the host
+var HOST_SHARED_DIR = "%s/_shared"
+
+// Returns all the values in the sections of the manifest, including the containers, jobs and init containers
+func (m Manifest) Values() []string {
+	values := []string{}
+	sections := []map[string][]string{m.Container, m.Unit, m.Service, m.Pod, m.Kube}
+	for _, containers := range []map[string]PodContainer{m.Containers, m.Jobs, m.Init} {
+		for _, container := range containers {
+			sections = append(sections, container.Container, container.Unit, container.Service)
+		}
+	}
+	for _, section := range sections {
+		for _, v := range section {
+			values = append(values, v...)
+		}
+	}
+	return values
+}
+
+// Returns the paths relative to the shared dir that are referenced in the texts, either as ${SHARED_DIR}/path or with
+// the absolute path of the shared dir (like in rendered templates). A reference to the shared dir itself, like a mount
+// of the whole dir, depends on all of it and is returned as "." instead of the other references.
+func SharedReferences(sharedDir string, texts ...string) []string {
+	pattern := regexp.MustCompile(fmt.Sprintf(`(?:\$\{SHARED_DIR\}|%s)(?:/([^\s:,;"'=]*))?`, regexp.QuoteMeta(sharedDir)))
+
+	found := make(map[string]struct{})
+	for _, text := range texts {
+		for _, match := range pattern.FindAllStringSubmatch(text, -1) {
+			found[filepath.Clean(match[1])] = struct{}{}
+		}
+	}
+	if _, ok := found["."]; ok {
+		return []string{"."}
+	}
+
+	references := make([]string, 0, len(found))
+	for rel := range found {
+		references = append(references, rel)
+	}
+	sort.Strings(references)
+	return references
+}
+
+// Returns the hashes of the referenced shared files and directories, as "shared:path=hash"
+func HashSharedFiles(sharedDir string, references []string, options HashOptions) ([]string, error) {
+	hashes := []string{}
+	for _, rel := range references {
+		path := sharedDir
+		if rel != "." {
+			var err error
+			if path, err = JoinInside(sharedDir, rel); err != nil {
+				return nil, err
+			}
+		}
+		if !PathExists(path) {
+			return nil, fmt.Errorf("shared file '%s' doesn't exist", rel)
+		}
+		hash, err := HashPath(path, options)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, fmt.Sprintf("shared:%s=%s", rel, hash))
+	}
+	return hashes, nil
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getsops/sops/v3/decrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Relative to the runtime dir, with service name. Decrypted files are written here, so they never end up in the
+// gitops repo.
+var SERVICE_SECRETS_DIR = "%s/gitops/%s/secrets"
+
+// Relative to home, the salt used when hashing the decrypted content of sops files
+var HASH_SALT_FILE_PATH = "%s/.local/state/gitops/hash-salt"
+
+var HASH_SALT_LENGTH = 32
+
+// Decrypts a sops file with the format, replaced in tests
+var decryptFile = decrypt.File
+
+// Returns $XDG_RUNTIME_DIR, which is a tmpfs only accessible by the user
+func RuntimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return fmt.Sprintf("/run/user/%d", os.Getuid())
+}
+
+// Returns true if the file is encrypted with sops, and should be decrypted into the secrets dir. The sops manifest is
+// merged into the manifest instead.
+func IsSopsFile(name string) bool {
+	if name == filepath.Base(fmt.Sprintf(SERVICE_MANIFEST_SOPS_FILE, "")) {
+		return false
+	}
+	return strings.Contains(name, ".sops.") || strings.HasSuffix(name, ".sops")
+}
+
+// Returns the name of the decrypted file, `config.sops.json` -> `config.json`, `.env.sops` -> `.env`
+func sopsFileTarget(name string) string {
+	if strings.HasSuffix(name, ".sops") {
+		return strings.TrimSuffix(name, ".sops")
+	}
+	return strings.Replace(name, ".sops.", ".", 1)
+}
+
+// Returns the sops format of the file, based on the extension of the decrypted file
+func sopsFileFormat(name string) string {
+	switch filepath.Ext(sopsFileTarget(name)) {
+	case ".yml", ".yaml":
+		return "yaml"
+	case ".json":
+		return "json"
+	case ".env":
+		return "dotenv"
+	case ".ini":
+		return "ini"
+	default:
+		return "binary"
+	}
+}
+
+// Returns true for the files in the service dir that are encrypted with sops, including the sops manifest
+func isEncryptedFile(name string) bool {
+	return IsSopsFile(name) || name == filepath.Base(fmt.Sprintf(SERVICE_MANIFEST_SOPS_FILE, ""))
+}
+
+// Returns a salted hash of the decrypted content of the sops file, so it only changes when the secrets change, and
+// not when the file is encrypted again (like when adding a recipient). Yaml and json are normalized, so the hash
+// doesn't depend on formatting. The salt makes it impossible to guess the secrets from the hash.
+func sopsContentHash(path string, salt []byte) ([]byte, error) {
+	format := sopsFileFormat(filepath.Base(path))
+	content, err := decryptFile(path, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt '%s' for hashing: %s", filepath.Base(path), err.Error())
+	}
+
+	if format == "yaml" || format == "json" {
+		var value interface{}
+		if err := yaml.Unmarshal(content, &value); err == nil {
+			if normalized, err := json.Marshal(value); err == nil {
+				content = normalized
+			}
+		}
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	_, _ = mac.Write(content)
+	return mac.Sum(nil), nil
+}
+
+// Returns a hash of the content keyed with the salt, for content that can contain secrets, like secret values and
+// rendered templates
+func SaltedHash(content []byte, salt []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	_, _ = mac.Write(content)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the salt used when hashing sops files, it's created the first time it's used
+func HashSalt() ([]byte, error) {
+	path := fmt.Sprintf(HASH_SALT_FILE_PATH, os.Getenv("HOME"))
+	salt, err := os.ReadFile(path)
+	if err == nil && len(salt) == HASH_SALT_LENGTH {
+		return salt, nil
+	}
+	if err == nil {
+		return nil, fmt.Errorf("invalid hash salt in '%s'", path)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	salt = make([]byte, HASH_SALT_LENGTH)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// The salt is written to a temporary file that is linked into place, so it can't be read before it's complete
+	file, err := os.CreateTemp(filepath.Dir(path), ".hash-salt-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(salt); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	err = os.Link(file.Name(), path)
+	if os.IsExist(err) {
+		// Created by another process, or another service, since it was read
+		return HashSalt()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Decrypts all sops files in the service dir into secretsDir. Files in secretsDir that don't have a corresponding sops
+// file anymore are removed.
+func DecryptServiceFiles(serviceDir string, secretsDir string) error {
+	files := make(map[string][]byte)
+
+	err := filepath.Walk(serviceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !IsSopsFile(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(serviceDir, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := decryptFile(path, sopsFileFormat(info.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to decrypt '%s': %s", rel, err.Error())
+		}
+
+		files[filepath.Join(filepath.Dir(rel), sopsFileTarget(info.Name()))] = content
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return SyncDir(secretsDir, files, 0600)
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Relative to the runtime dir, with service name. Rendered templates are written here, since they can contain secrets.
+var SERVICE_RENDERED_DIR = "%s/gitops/%s/rendered"
+
+// Suffix of files in the service dir that should be rendered
+var TEMPLATE_SUFFIX = ".tmpl"
+
+func IsTemplateFile(name string) bool {
+	return strings.HasSuffix(name, TEMPLATE_SUFFIX)
+}
+
+// Renders a template, with the vars available as `{{ .NAME }}`, and secrets as `{{ secret "name" }}`
+func RenderTemplate(name string, content string, vars map[string]string, secrets map[string]string) ([]byte, error) {
+	funcs := template.FuncMap{
+		"secret": func(name string) (string, error) {
+			value, ok := secrets[name]
+			if !ok {
+				return "", fmt.Errorf("secret '%s' doesn't exist", name)
+			}
+			return value, nil
+		},
+	}
+
+	t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err := t.Execute(&rendered, vars); err != nil {
+		return nil, err
+	}
+
+	return rendered.Bytes(), nil
+}
+
+// Renders all the templates in the service dir into renderedDir, without the template suffix. Returns the rendered
+// files, relative path -> content.
+func RenderServiceTemplates(serviceDir string, renderedDir string, vars map[string]string, secrets map[string]string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+
+	err := filepath.Walk(serviceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !IsTemplateFile(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(serviceDir, path)
+		if err != nil {
+			return err
+		}
+
+		content, err := ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rendered, err := RenderTemplate(rel, content, vars, secrets)
+		if err != nil {
+			return fmt.Errorf("failed to render '%s': %s", rel, err.Error())
+		}
+
+		files[strings.TrimSuffix(rel, TEMPLATE_SUFFIX)] = rendered
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The files can contain secrets, so they are only readable by the user like the decrypted files
+	return files, SyncDir(renderedDir, files, 0600)
+}
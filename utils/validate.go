@@ -0,0 +1,503 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (err ValidationError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", err.File, err.Line, err.Column, err.Message)
+}
+
+// Several validation errors returned as one error, one per line
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+	lines := []string{}
+	for _, err := range errs {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Keys in config.yml
+var CONFIG_KEYS = []string{"pre", "post", "networks", "volumes", "images", "services", "vars", "workers", "hashing", "massRemoval"}
+
+// Keys for pre and post in config.yml
+var PRE_POST_KEYS = []string{"script"}
+
+// Keys for massRemoval in config.yml
+var MASS_REMOVAL_KEYS = []string{"maxServices", "maxPercent", "minServices"}
+
+// Keys for each service in config.yml
+var SERVICE_CONFIG_KEYS = []string{"vars", "kind", "schedule", "imageUpdates"}
+
+// Keys for the reload section of the manifest
+var RELOAD_KEYS = []string{"files", "signal", "exec", "execReload", "container"}
+
+// Keys in the sops manifest that aren't sections
+var SOPS_MANIFEST_KEYS = []string{SOPS_SECRETS_KEY, "sops"}
+
+// Keys for the [Container] section of quadlet container units
+var CONTAINER_KEYS = []string{
+	"AddCapability", "AddDevice", "AddHost", "Annotation", "AutoUpdate", "CgroupsMode", "ContainerName",
+	"ContainersConfModule", "DNS", "DNSOption", "DNSSearch", "DropCapability", "Entrypoint", "Environment",
+	"EnvironmentFile", "EnvironmentHost", "Exec", "ExposeHostPort", "GIDMap", "GlobalArgs", "Group", "GroupAdd",
+	"HealthCmd", "HealthInterval", "HealthLogDestination", "HealthMaxLogCount", "HealthMaxLogSize", "HealthOnFailure",
+	"HealthRetries", "HealthStartPeriod", "HealthStartupCmd", "HealthStartupInterval", "HealthStartupRetries",
+	"HealthStartupSuccess", "HealthStartupTimeout", "HealthTimeout", "HostName", "Image", "IP", "IP6", "Label",
+	"LogDriver", "LogOpt", "Mask", "Memory", "Mount", "Network", "NetworkAlias", "NoNewPrivileges", "Notify",
+	"PidsLimit", "Pod", "PodmanArgs", "PublishPort", "Pull", "ReadOnly", "ReadOnlyTmpfs", "ReloadCmd",
+	"ReloadSignal", "Retry", "RetryDelay", "Rootfs", "RunInit", "SeccompProfile", "Secret", "SecurityLabelDisable",
+	"SecurityLabelFileType", "SecurityLabelLevel", "SecurityLabelNested", "SecurityLabelType", "ShmSize",
+	"StartWithPod", "StopSignal", "StopTimeout", "SubGIDMap", "SubUIDMap", "Sysctl", "Timezone", "Tmpfs", "UIDMap",
+	"Ulimit", "Unmask", "User", "UserNS", "Volume", "WorkingDir",
+}
+
+// Keys for the [Unit] section of systemd units
+var UNIT_KEYS = []string{
+	"Description", "Documentation", "Wants", "Requires", "Requisite", "BindsTo", "PartOf", "Upholds", "Conflicts",
+	"Before", "After", "OnFailure", "OnSuccess", "PropagatesReloadTo", "ReloadPropagatedFrom", "PropagatesStopTo",
+	"StopPropagatedFrom", "JoinsNamespaceOf", "RequiresMountsFor", "WantsMountsFor", "OnFailureJobMode",
+	"IgnoreOnIsolate", "StopWhenUnneeded", "RefuseManualStart", "RefuseManualStop", "AllowIsolate",
+	"DefaultDependencies", "SurviveFinalKillSignal", "CollectMode", "FailureAction", "SuccessAction",
+	"FailureActionExitStatus", "SuccessActionExitStatus", "JobTimeoutSec", "JobRunningTimeoutSec",
+	"JobTimeoutAction", "JobTimeoutRebootArgument", "StartLimitIntervalSec", "StartLimitBurst", "StartLimitAction",
+	"RebootArgument", "SourcePath",
+}
+
+// Prefixes of keys for the [Unit] section, like ConditionPathExists
+var UNIT_KEY_PREFIXES = []string{"Condition", "Assert"}
+
+// Keys for the [Service] section of systemd units, from systemd.service
+var SERVICE_KEYS = []string{
+	"Type", "ExitType", "RemainAfterExit", "GuessMainPID", "PIDFile", "BusName", "ExecStart", "ExecStartPre",
+	"ExecStartPost", "ExecCondition", "ExecReload", "ExecStop", "ExecStopPost", "RestartSec", "RestartSteps",
+	"RestartMaxDelaySec", "TimeoutStartSec", "TimeoutStopSec", "TimeoutAbortSec", "TimeoutSec",
+	"TimeoutStartFailureMode", "TimeoutStopFailureMode", "RuntimeMaxSec", "RuntimeRandomizedExtraSec",
+	"WatchdogSec", "Restart", "RestartMode", "SuccessExitStatus", "RestartPreventExitStatus",
+	"RestartForceExitStatus", "RootDirectoryStartOnly", "NonBlocking", "NotifyAccess", "Sockets",
+	"FileDescriptorStoreMax", "FileDescriptorStorePreserve", "USBFunctionDescriptors", "USBFunctionStrings",
+	"OOMPolicy", "OpenFile", "ReloadSignal",
+}
+
+// Keys for the [Service] section from systemd.exec
+var EXEC_KEYS = []string{
+	"ExecSearchPath", "WorkingDirectory", "RootDirectory", "RootImage", "RootImageOptions", "RootEphemeral",
+	"RootHash", "RootHashSignature", "RootVerity", "RootImagePolicy", "MountImagePolicy", "ExtensionImagePolicy",
+	"MountAPIVFS", "ProtectProc", "ProcSubset", "BindPaths", "BindReadOnlyPaths", "MountImages", "ExtensionImages",
+	"ExtensionDirectories", "User", "Group", "DynamicUser", "SupplementaryGroups", "SetLoginEnvironment", "PAMName",
+	"CapabilityBoundingSet", "AmbientCapabilities", "NoNewPrivileges", "SecureBits", "SELinuxContext",
+	"AppArmorProfile", "SmackProcessLabel", "UMask", "CoredumpFilter", "KeyringMode", "OOMScoreAdjust",
+	"TimerSlackNSec", "Personality", "IgnoreSIGPIPE", "Nice", "CPUSchedulingPolicy", "CPUSchedulingPriority",
+	"CPUSchedulingResetOnFork", "CPUAffinity", "NUMAPolicy", "NUMAMask", "IOSchedulingClass", "IOSchedulingPriority",
+	"ProtectSystem", "ProtectHome", "RuntimeDirectory", "StateDirectory", "CacheDirectory", "LogsDirectory",
+	"ConfigurationDirectory", "RuntimeDirectoryMode", "StateDirectoryMode", "CacheDirectoryMode",
+	"LogsDirectoryMode", "ConfigurationDirectoryMode", "RuntimeDirectoryPreserve", "TimeoutCleanSec",
+	"ReadWritePaths", "ReadOnlyPaths", "InaccessiblePaths", "ExecPaths", "NoExecPaths", "TemporaryFileSystem",
+	"PrivateTmp", "PrivateDevices", "PrivateNetwork", "NetworkNamespacePath", "PrivateIPC", "IPCNamespacePath",
+	"MemoryKSM", "PrivateUsers", "ProtectHostname", "ProtectClock", "ProtectKernelTunables", "ProtectKernelModules",
+	"ProtectKernelLogs", "ProtectControlGroups", "RestrictAddressFamilies", "RestrictFileSystems",
+	"RestrictNamespaces", "LockPersonality", "MemoryDenyWriteExecute", "RestrictRealtime", "RestrictSUIDSGID",
+	"RemoveIPC", "PrivateMounts", "MountFlags", "SystemCallFilter", "SystemCallErrorNumber",
+	"SystemCallArchitectures", "SystemCallLog", "Environment", "EnvironmentFile", "PassEnvironment",
+	"UnsetEnvironment", "StandardInput", "StandardOutput", "StandardError", "StandardInputText",
+	"StandardInputData", "LogLevelMax", "LogExtraFields", "LogRateLimitIntervalSec", "LogRateLimitBurst",
+	"LogFilterPatterns", "LogNamespace", "SyslogIdentifier", "SyslogFacility", "SyslogLevel", "SyslogLevelPrefix",
+	"TTYPath", "TTYReset", "TTYVHangup", "TTYColumns", "TTYRows", "TTYVTDisallocate", "LoadCredential",
+	"LoadCredentialEncrypted", "ImportCredential", "SetCredential", "SetCredentialEncrypted", "UtmpIdentifier",
+	"UtmpMode",
+}
+
+// Keys for the [Service] section from systemd.kill
+var KILL_KEYS = []string{
+	"KillMode", "KillSignal", "RestartKillSignal", "SendSIGHUP", "SendSIGKILL", "FinalKillSignal", "WatchdogSignal",
+}
+
+// Keys for the [Service] section from systemd.resource-control
+var RESOURCE_CONTROL_KEYS = []string{
+	"CPUAccounting", "CPUWeight", "StartupCPUWeight", "CPUQuota", "CPUQuotaPeriodSec", "AllowedCPUs",
+	"StartupAllowedCPUs", "AllowedMemoryNodes", "StartupAllowedMemoryNodes", "MemoryAccounting", "MemoryMin",
+	"MemoryLow", "StartupMemoryLow", "DefaultStartupMemoryLow", "MemoryHigh", "StartupMemoryHigh", "MemoryMax",
+	"StartupMemoryMax", "MemorySwapMax", "StartupMemorySwapMax", "MemoryZSwapMax", "StartupMemoryZSwapMax",
+	"MemoryZSwapWriteback", "TasksAccounting", "TasksMax", "IOAccounting", "IOWeight", "StartupIOWeight",
+	"IODeviceWeight", "IOReadBandwidthMax", "IOWriteBandwidthMax", "IOReadIOPSMax", "IOWriteIOPSMax",
+	"IODeviceLatencyTargetSec", "IPAccounting", "IPAddressAllow", "IPAddressDeny", "SocketBindAllow",
+	"SocketBindDeny", "RestrictNetworkInterfaces", "NFTSet", "IPIngressFilterPath", "IPEgressFilterPath",
+	"BPFProgram", "DeviceAllow", "DevicePolicy", "Slice", "Delegate", "DelegateSubgroup", "DisableControllers",
+	"ManagedOOMSwap", "ManagedOOMMemoryPressure", "ManagedOOMMemoryPressureLimit",
+	"ManagedOOMMemoryPressureDurationSec", "ManagedOOMPreference", "MemoryPressureWatch",
+	"MemoryPressureThresholdSec", "CoredumpReceive", "CPUShares", "StartupCPUShares", "MemoryLimit",
+	"BlockIOAccounting", "BlockIOWeight", "StartupBlockIOWeight", "BlockIODeviceWeight", "BlockIOReadBandwidth",
+	"BlockIOWriteBandwidth",
+}
+
+// Keys for the [Pod] section of quadlet pod units
+var POD_KEYS = []string{
+	"AddHost", "ContainersConfModule", "DNS", "DNSOption", "DNSSearch", "ExitPolicy", "GIDMap", "GlobalArgs",
+	"HostName", "IP", "IP6", "Label", "Network", "NetworkAlias", "PodmanArgs", "PodName", "PublishPort",
+	"ServiceName", "ShmSize", "StopTimeout", "SubGIDMap", "SubUIDMap", "UIDMap", "UserNS", "Volume",
+}
+
+// Keys for the [Kube] section of quadlet kube units, Yaml is set by gitops
+var KUBE_KEYS = []string{
+	"AutoUpdate", "ConfigMap", "ContainersConfModule", "ExitCodePropagation", "GlobalArgs", "KubeDownForce",
+	"LogDriver", "Network", "PodmanArgs", "PublishPort", "SetWorkingDirectory", "UserNS",
+}
+
+// Keys for the [Image] section of quadlet image units, for the images in config.yml
+var IMAGE_KEYS = []string{
+	"AllTags", "Arch", "AuthFile", "CertDir", "ContainersConfModule", "Creds", "DecryptionKey", "GlobalArgs",
+	"Image", "ImageTag", "OS", "PodmanArgs", "TLSVerify", "Variant",
+}
+
+// Prefixes of keys for the [Service] section, the resource limits like LimitNOFILE
+var SERVICE_KEY_PREFIXES = []string{"Limit"}
+
+type sectionKeys struct {
+	keys     []string
+	prefixes []string
+}
+
+// Returns the valid keys of the [Service] section
+func serviceKeys() []string {
+	keys := append([]string{}, SERVICE_KEYS...)
+	keys = append(keys, EXEC_KEYS...)
+	keys = append(keys, KILL_KEYS...)
+	return append(keys, RESOURCE_CONTROL_KEYS...)
+}
+
+// Returns the valid keys of the manifest sections
+func manifestSectionKeys() map[string]sectionKeys {
+	return map[string]sectionKeys{
+		"Container": {CONTAINER_KEYS, nil},
+		"Unit":      {UNIT_KEYS, UNIT_KEY_PREFIXES},
+		"Service":   {serviceKeys(), SERVICE_KEY_PREFIXES},
+		"Pod":       {POD_KEYS, nil},
+		"Kube":      {KUBE_KEYS, nil},
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefix(prefixes []string, value string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// Converts errors from the yaml parser to validation errors, the yaml errors only have a line number
+func yamlErrors(file string, err error) []ValidationError {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+
+	errs := []ValidationError{}
+	for _, message := range messages {
+		line := 0
+		if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+			line, _ = strconv.Atoi(match[1])
+		}
+		errs = append(errs, ValidationError{File: file, Line: line, Column: 1, Message: message})
+	}
+	return errs
+}
+
+func nodeError(file string, node *yaml.Node, format string, args ...interface{}) ValidationError {
+	return ValidationError{File: file, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+// Returns the key and value nodes of a mapping node
+func mappingPairs(node *yaml.Node) [][2]*yaml.Node {
+	pairs := [][2]*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		pairs = append(pairs, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+	}
+	return pairs
+}
+
+// Parses a yaml file, returning the top level mapping node
+func readYamlFile(file string) (*yaml.Node, []ValidationError) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, []ValidationError{{File: file, Message: err.Error()}}
+	}
+
+	document := yaml.Node{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, yamlErrors(file, err)
+	}
+	if len(document.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode}, nil
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, []ValidationError{nodeError(file, root, "expected a mapping")}
+	}
+	return root, nil
+}
+
+// Checks that all the keys in the mapping node are known
+func validateKeys(file string, node *yaml.Node, keys []string, what string) []ValidationError {
+	errs := []ValidationError{}
+	if node.Kind != yaml.MappingNode {
+		if node.Tag != "!!null" {
+			errs = append(errs, nodeError(file, node, "expected a mapping for %s", what))
+		}
+		return errs
+	}
+	for _, pair := range mappingPairs(node) {
+		if !contains(keys, pair[0].Value) {
+			errs = append(errs, nodeError(file, pair[0], "unknown key '%s' in %s", pair[0].Value, what))
+		}
+	}
+	return errs
+}
+
+func validateConfig(file string) []ValidationError {
+	root, errs := readYamlFile(file)
+	if root == nil {
+		return errs
+	}
+
+	errs = append(errs, validateKeys(file, root, CONFIG_KEYS, "config")...)
+
+	for _, pair := range mappingPairs(root) {
+		switch pair[0].Value {
+		case "pre", "post":
+			errs = append(errs, validateKeys(file, pair[1], PRE_POST_KEYS, pair[0].Value)...)
+		case "massRemoval":
+			errs = append(errs, validateKeys(file, pair[1], MASS_REMOVAL_KEYS, pair[0].Value)...)
+		case "networks", "volumes":
+			kind := strings.TrimSuffix(pair[0].Value, "s")
+			for _, named := range mappingPairs(pair[1]) {
+				if err := ValidateName(kind, named[0].Value); err != nil {
+					errs = append(errs, nodeError(file, named[0], "%s", err.Error()))
+				}
+			}
+		case "images":
+			for _, named := range mappingPairs(pair[1]) {
+				if err := ValidateName("image", named[0].Value); err != nil {
+					errs = append(errs, nodeError(file, named[0], "%s", err.Error()))
+				}
+				errs = append(errs, validateKeys(file, named[1], IMAGE_KEYS, fmt.Sprintf("image '%s'", named[0].Value))...)
+				hasImage := false
+				for _, key := range mappingPairs(named[1]) {
+					hasImage = hasImage || key[0].Value == "Image"
+				}
+				if !hasImage {
+					errs = append(errs, nodeError(file, named[0], "image '%s' doesn't have an Image", named[0].Value))
+				}
+			}
+		case "services":
+			if pair[1].Kind != yaml.MappingNode {
+				errs = append(errs, nodeError(file, pair[1], "expected a mapping for services"))
+				continue
+			}
+			for _, service := range mappingPairs(pair[1]) {
+				if err := ValidateName("service", service[0].Value); err != nil {
+					errs = append(errs, nodeError(file, service[0], "%s", err.Error()))
+				}
+				errs = append(errs, validateKeys(file, service[1], SERVICE_CONFIG_KEYS, fmt.Sprintf("service '%s'", service[0].Value))...)
+				serviceConfig := Service{}
+				if err := service[1].Decode(&serviceConfig); err == nil {
+					if err := serviceConfig.validate(); err != nil {
+						errs = append(errs, nodeError(file, service[0], "service '%s': %s", service[0].Value, err.Error()))
+					}
+				}
+			}
+		}
+	}
+
+	config := Config{}
+	if err := root.Decode(&config); err != nil {
+		errs = append(errs, yamlErrors(file, err)...)
+	}
+
+	return errs
+}
+
+// Validates a section of a manifest
+func validateSection(file string, name string, node *yaml.Node, section sectionKeys, sops bool) []ValidationError {
+	errs := []ValidationError{}
+	if node.Kind != yaml.MappingNode {
+		if node.Tag != "!!null" {
+			errs = append(errs, nodeError(file, node, "expected a mapping for section '%s'", name))
+		}
+		return errs
+	}
+	for _, kv := range mappingPairs(node) {
+		key := kv[0].Value
+		if sops {
+			key = strings.TrimSuffix(key, SOPS_REPLACE_SUFFIX)
+		}
+		if !contains(section.keys, key) && !hasPrefix(section.prefixes, key) {
+			errs = append(errs, nodeError(file, kv[0], "unknown key '%s' in section '%s'", key, name))
+		}
+		if kv[1].Kind != yaml.SequenceNode && kv[1].Tag != "!!null" {
+			errs = append(errs, nodeError(file, kv[1], "expected a list of values for '%s'", key))
+		}
+	}
+	return errs
+}
+
+// Validates the containers of a pod (key Containers, kind container), the jobs (key jobs, kind job) or the init
+// containers (key init, kind init container)
+func validateContainers(file string, node *yaml.Node, sops bool, key string, kind string) []ValidationError {
+	errs := []ValidationError{}
+	if node.Kind != yaml.MappingNode {
+		if node.Tag != "!!null" {
+			errs = append(errs, nodeError(file, node, "expected a mapping for %s", key))
+		}
+		return errs
+	}
+
+	sections := manifestSectionKeys()
+	for _, container := range mappingPairs(node) {
+		if err := ValidateName(kind, container[0].Value); err != nil {
+			errs = append(errs, nodeError(file, container[0], "%s", err.Error()))
+		}
+		if container[1].Kind != yaml.MappingNode {
+			errs = append(errs, nodeError(file, container[1], "expected a mapping for %s '%s'", kind, container[0].Value))
+			continue
+		}
+		for _, pair := range mappingPairs(container[1]) {
+			sectionName := pair[0].Value
+			section, ok := sections[sectionName]
+			if !ok || sectionName == "Pod" || sectionName == "Kube" {
+				errs = append(errs, nodeError(file, pair[0], "unknown section '%s' in %s '%s'", sectionName, kind, container[0].Value))
+				continue
+			}
+			errs = append(errs, validateSection(file, sectionName, pair[1], section, sops)...)
+		}
+	}
+	return errs
+}
+
+// Validates the sections and keys of a manifest. The keys of sops files aren't encrypted, so the sops manifest can be
+// validated without decrypting it.
+func validateManifest(file string, sops bool) []ValidationError {
+	root, errs := readYamlFile(file)
+	if root == nil {
+		return errs
+	}
+
+	sections := manifestSectionKeys()
+
+	for _, pair := range mappingPairs(root) {
+		sectionName := pair[0].Value
+		if sops && contains(SOPS_MANIFEST_KEYS, sectionName) {
+			continue
+		}
+		if sectionName == SOPS_CONTAINERS_KEY {
+			errs = append(errs, validateContainers(file, pair[1], sops, SOPS_CONTAINERS_KEY, "container")...)
+			continue
+		}
+		if sectionName == MANIFEST_JOBS_KEY && !sops {
+			errs = append(errs, validateContainers(file, pair[1], sops, MANIFEST_JOBS_KEY, "job")...)
+			continue
+		}
+		if sectionName == MANIFEST_INIT_KEY && !sops {
+			errs = append(errs, validateContainers(file, pair[1], sops, MANIFEST_INIT_KEY, "init container")...)
+			continue
+		}
+		if sectionName == MANIFEST_RELOAD_KEY && !sops {
+			errs = append(errs, validateKeys(file, pair[1], RELOAD_KEYS, MANIFEST_RELOAD_KEY)...)
+			continue
+		}
+		section, ok := sections[sectionName]
+		if !ok {
+			errs = append(errs, nodeError(file, pair[0], "unknown section '%s'", sectionName))
+			continue
+		}
+		errs = append(errs, validateSection(file, sectionName, pair[1], section, sops)...)
+	}
+
+	return errs
+}
+
+// Validates the config and the manifests of all the services for the host
+// Returns the error from config.Validate at the key in config.yml it's about, found by validating each key on its own
+func validateConfigValues(file string, config Config) []ValidationError {
+	err := config.Validate()
+	if err == nil {
+		return nil
+	}
+	root, _ := readYamlFile(file)
+	if root != nil {
+		for _, pair := range mappingPairs(root) {
+			partial := Config{}
+			node := yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{pair[0], pair[1]}}
+			if node.Decode(&partial) == nil && partial.Validate() != nil {
+				return []ValidationError{nodeError(file, pair[0], "%s", err.Error())}
+			}
+		}
+	}
+	return []ValidationError{{File: file, Message: err.Error()}}
+}
+
+func ValidateHost(hostGitopsDir string) []ValidationError {
+	configFile := fmt.Sprintf(CONFIG_FILE_PATH, hostGitopsDir)
+	errs := validateConfig(configFile)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	config, err := ReadConfigFile(configFile)
+	if err != nil {
+		return append(errs, ValidationError{File: configFile, Message: err.Error()})
+	}
+	// The same checks as when the services are started
+	errs = append(errs, validateConfigValues(configFile, config)...)
+
+	services := make([]string, 0, len(config.Services))
+	for service := range config.Services {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		serviceDir, err := JoinInside(hostGitopsDir, service)
+		if err != nil {
+			errs = append(errs, ValidationError{File: configFile, Message: err.Error()})
+			continue
+		}
+
+		if PathExists(fmt.Sprintf(SERVICE_QUADLET_FILE, serviceDir)) {
+			continue
+		}
+
+		errs = append(errs, validateManifest(fmt.Sprintf(SERVICE_MANIFEST_FILE, serviceDir), false)...)
+		if sopsFile := fmt.Sprintf(SERVICE_MANIFEST_SOPS_FILE, serviceDir); PathExists(sopsFile) {
+			errs = append(errs, validateManifest(sopsFile, true)...)
+		}
+	}
+
+	return errs
+}